@@ -0,0 +1,258 @@
+// Package blobs manages stored content objects: the reference-counted rows
+// of the blobs table, the bodies behind them in blob storage, and the
+// optional chunk-level layout used for large files.
+package blobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/envelope"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrNotFound is returned when no blob has the requested hash.
+var ErrNotFound = errors.New("blob not found")
+
+// Blob is a row of the blobs table.
+type Blob struct {
+	Hash        string
+	Size        int64  // logical size of the content
+	StoredSize  int64  // bytes in storage for the body; 0 for chunked blobs
+	StorageKey  string // "<backend>:<key>", empty for chunked blobs
+	Chunked     bool
+	Compression string // "" or "gzip"
+	WrappedKey  []byte // data key wrapped by master key KeyID; nil if not encrypted
+	KeyID       string
+	CreatedAt   time.Time
+	Integrity   string // result of the last scrub: "", "ok", "corrupt" or "missing"
+}
+
+// Integrity results recorded by the scrubber.
+const (
+	IntegrityOK      = "ok"
+	IntegrityCorrupt = "corrupt"
+	IntegrityMissing = "missing"
+)
+
+// Available reports whether the blob can be served: it has not failed its
+// last integrity check.
+func (b *Blob) Available() bool {
+	return b.Integrity != IntegrityCorrupt && b.Integrity != IntegrityMissing
+}
+
+// Querier is satisfied by both the connection pool and a transaction.
+type Querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// Get loads the blob with the given hash.
+func Get(ctx context.Context, q Querier, hash string) (*Blob, error) {
+	var b Blob
+	err := q.QueryRow(ctx,
+		`SELECT hash, size, stored_size, storage_key, chunked, compression, wrapped_key, COALESCE(key_id, ''), created_at, integrity
+		 FROM blobs WHERE hash=$1`, hash,
+	).Scan(&b.Hash, &b.Size, &b.StoredSize, &b.StorageKey, &b.Chunked, &b.Compression, &b.WrappedKey, &b.KeyID, &b.CreatedAt, &b.Integrity)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Acquire adds a reference to the blob holding the staged content inside
+// tx. When no file in the system has that content yet the blob row is
+// created and the body committed to storage, whole or as chunks, and
+// compressed if mimeType or the content suggest it pays off; shared
+// reports whether an existing blob was reused.
+func Acquire(ctx context.Context, tx pgx.Tx, staged *storage.TempBlob, mimeType string) (shared bool, err error) {
+	chunked := chunkingEnabled() && staged.Size >= chunkThreshold()
+	key := storage.Ref(storage.HashKey(staged.Hash))
+	if chunked {
+		key = ""
+	}
+
+	var inserted bool
+	err = tx.QueryRow(ctx, `
+		INSERT INTO blobs (hash, size, stored_size, storage_key, chunked, ref_count) VALUES ($1, $2, $3, $4, $5, 1)
+		ON CONFLICT (hash) DO UPDATE SET ref_count = blobs.ref_count + 1
+		RETURNING (xmax = 0)`,
+		staged.Hash, staged.Size, storedSize(staged, chunked), key, chunked,
+	).Scan(&inserted)
+	if err != nil || !inserted {
+		return !inserted, err
+	}
+
+	if chunked {
+		return false, storeChunks(ctx, tx, staged)
+	}
+
+	body := staged
+	if ok, err := shouldCompress(staged, mimeType); err != nil {
+		return false, err
+	} else if ok {
+		packed, err := compress(staged)
+		if err != nil {
+			return false, err
+		}
+		if packed != nil {
+			defer packed.Close()
+			body = packed
+			_, err = tx.Exec(ctx,
+				"UPDATE blobs SET compression='gzip', stored_size=$1 WHERE hash=$2", packed.Size, staged.Hash)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	if envelope.Enabled() {
+		enc, seal, err := encryptBody(body, staged.Hash)
+		if err != nil {
+			return false, err
+		}
+		defer enc.Close()
+		body = enc
+		_, err = tx.Exec(ctx,
+			"UPDATE blobs SET wrapped_key=$1, key_id=$2, stored_size=$3 WHERE hash=$4",
+			seal.wrappedKey, seal.keyID, enc.Size, staged.Hash)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	store, k, err := storage.Resolve(key)
+	if err != nil {
+		return false, err
+	}
+	// Always write: a body left behind by an earlier failed upload may
+	// have been stored with a different encoding.
+	return false, body.Commit(ctx, store, k)
+}
+
+func storedSize(staged *storage.TempBlob, chunked bool) int64 {
+	if chunked {
+		return 0
+	}
+	return staged.Size
+}
+
+// Retain adds a reference to a blob that is already stored, for a new
+// files or file_versions row pointing at the same content.
+func Retain(ctx context.Context, tx pgx.Tx, hash string) error {
+	tag, err := tx.Exec(ctx, "UPDATE blobs SET ref_count = ref_count + 1 WHERE hash=$1", hash)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// Release drops one reference to a blob inside tx. When it was the last one
+// the blob row is deleted, along with any chunks nothing else uses, and the
+// storage references to remove after committing are returned.
+func Release(ctx context.Context, tx pgx.Tx, hash string) ([]string, error) {
+	var refCount int
+	var key string
+	var chunked bool
+	err := tx.QueryRow(ctx,
+		"UPDATE blobs SET ref_count = ref_count - 1 WHERE hash=$1 RETURNING ref_count, storage_key, chunked", hash,
+	).Scan(&refCount, &key, &chunked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil || refCount > 0 {
+		return nil, err
+	}
+	return drop(ctx, tx, hash, key, chunked)
+}
+
+// DropUnreferenced deletes a blob row that no file points at any more,
+// returning the storage references to remove like Release does.
+func DropUnreferenced(ctx context.Context, tx pgx.Tx, hash string) ([]string, error) {
+	var key string
+	var chunked bool
+	err := tx.QueryRow(ctx,
+		"SELECT storage_key, chunked FROM blobs WHERE hash=$1 AND ref_count <= 0 FOR UPDATE", hash,
+	).Scan(&key, &chunked)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return drop(ctx, tx, hash, key, chunked)
+}
+
+func drop(ctx context.Context, tx pgx.Tx, hash, key string, chunked bool) ([]string, error) {
+	var orphans []string
+	if chunked {
+		var err error
+		if orphans, err = releaseChunks(ctx, tx, hash); err != nil {
+			return nil, err
+		}
+	} else {
+		orphans = append(orphans, key)
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM blobs WHERE hash=$1", hash); err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// Remove deletes blob bodies the database no longer points at, logging
+// rather than failing since nothing can reach them any more.
+func Remove(ctx context.Context, refs []string) {
+	for _, ref := range refs {
+		store, key, err := storage.Resolve(ref)
+		if err == nil {
+			err = store.Delete(ctx, key)
+		}
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Failed to remove blob %s: %v", ref, err)
+		}
+	}
+}
+
+// Open reads the whole blob.
+func (b *Blob) Open(ctx context.Context) (io.ReadCloser, error) {
+	return b.OpenRange(ctx, 0, -1)
+}
+
+// OpenRange reads length bytes from offset; a negative length reads to the
+// end. Chunked blobs are reassembled on the fly.
+func (b *Blob) OpenRange(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || offset > b.Size {
+		return nil, fmt.Errorf("offset %d out of range for blob of %d bytes", offset, b.Size)
+	}
+	if length < 0 || offset+length > b.Size {
+		length = b.Size - offset
+	}
+
+	if b.Chunked {
+		return openChunks(ctx, db.DB, b.Hash, offset, length)
+	}
+
+	if b.Compression == "gzip" {
+		// The stored (pre-encryption) stream is the compressed one
+		encoded := b.StoredSize
+		if b.WrappedKey != nil {
+			encoded = envelope.PlaintextSize(b.StoredSize)
+		}
+		body, err := openBody(ctx, b.StorageKey, b.WrappedKey, b.KeyID, b.Hash, encoded, 0, encoded)
+		if err != nil {
+			return nil, err
+		}
+		return decompress(body, offset, length)
+	}
+	return openBody(ctx, b.StorageKey, b.WrappedKey, b.KeyID, b.Hash, b.Size, offset, length)
+}
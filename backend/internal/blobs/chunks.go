@@ -0,0 +1,234 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/envelope"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+	"github.com/jackc/pgx/v5"
+)
+
+// Chunk size bounds for content-defined chunking.
+const (
+	minChunkSize = 64 << 10
+	avgChunkSize = 256 << 10
+	maxChunkSize = 1 << 20
+)
+
+// chunkingEnabled reports whether large blobs are split into chunks
+// (CHUNKING=fastcdc).
+func chunkingEnabled() bool {
+	return os.Getenv("CHUNKING") == "fastcdc"
+}
+
+// chunkThreshold is the smallest blob that gets chunked, from
+// CHUNK_THRESHOLD in bytes (default 8 MiB).
+func chunkThreshold() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("CHUNK_THRESHOLD"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 8 << 20
+}
+
+func chunkKey(hash string) string {
+	return "chunks/" + storage.HashKey(hash)
+}
+
+// storeChunks splits the staged content into chunks and records the
+// manifest for its blob, writing only chunks no other blob has.
+func storeChunks(ctx context.Context, tx pgx.Tx, staged *storage.TempBlob) error {
+	r, err := staged.Rewind()
+	if err != nil {
+		return err
+	}
+
+	chunker := NewChunker(r, minChunkSize, avgChunkSize, maxChunkSize)
+	var offset int64
+	for seq := 0; ; seq++ {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		key := storage.Ref(chunkKey(hash))
+
+		// Encrypt up front; the key is only kept if the chunk is new
+		body := data
+		var seal sealed
+		if envelope.Enabled() {
+			enc, s, err := encryptBytes(data, hash)
+			if err != nil {
+				return err
+			}
+			body, seal = enc, *s
+		}
+
+		var inserted bool
+		err = tx.QueryRow(ctx, `
+			INSERT INTO chunks (hash, size, storage_key, wrapped_key, key_id, ref_count) VALUES ($1, $2, $3, $4, $5, 1)
+			ON CONFLICT (hash) DO UPDATE SET ref_count = chunks.ref_count + 1
+			RETURNING storage_key, (xmax = 0)`,
+			hash, len(data), key, seal.wrappedKey, nullIfEmpty(seal.keyID),
+		).Scan(&key, &inserted)
+		if err != nil {
+			return err
+		}
+		if inserted {
+			store, k, err := storage.Resolve(key)
+			if err != nil {
+				return err
+			}
+			if _, err := store.Put(ctx, k, bytes.NewReader(body)); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO blob_chunks (blob_hash, seq, chunk_hash, chunk_offset, size)
+			VALUES ($1, $2, $3, $4, $5)`,
+			staged.Hash, seq, hash, offset, len(data))
+		if err != nil {
+			return err
+		}
+		offset += int64(len(data))
+	}
+}
+
+// releaseChunks drops the chunk references held by a blob's manifest and
+// returns the storage references of chunks that are no longer used.
+func releaseChunks(ctx context.Context, tx pgx.Tx, blobHash string) ([]string, error) {
+	_, err := tx.Exec(ctx, `
+		UPDATE chunks c SET ref_count = c.ref_count - m.n
+		FROM (SELECT chunk_hash, COUNT(*) AS n FROM blob_chunks WHERE blob_hash=$1 GROUP BY chunk_hash) m
+		WHERE c.hash = m.chunk_hash`, blobHash)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, "DELETE FROM blob_chunks WHERE blob_hash=$1 RETURNING chunk_hash", blobHash)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx,
+		"DELETE FROM chunks WHERE hash = ANY($1) AND ref_count <= 0 RETURNING storage_key", hashes)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+type chunkPart struct {
+	hash       string
+	key        string
+	wrappedKey []byte
+	keyID      string
+	size       int64
+	offset     int64 // within the chunk
+	length     int64
+}
+
+// openChunks returns a reader over [offset, offset+length) of a chunked
+// blob that opens each chunk only when it is reached.
+func openChunks(ctx context.Context, q Querier, blobHash string, offset, length int64) (io.ReadCloser, error) {
+	rows, err := q.Query(ctx, `
+		SELECT c.hash, c.storage_key, c.wrapped_key, COALESCE(c.key_id, ''), bc.chunk_offset, bc.size
+		FROM blob_chunks bc JOIN chunks c ON c.hash = bc.chunk_hash
+		WHERE bc.blob_hash=$1 AND bc.chunk_offset + bc.size > $2 AND bc.chunk_offset < $3
+		ORDER BY bc.seq`,
+		blobHash, offset, offset+length)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	end := offset + length
+	var parts []chunkPart
+	for rows.Next() {
+		var p chunkPart
+		var start int64
+		if err := rows.Scan(&p.hash, &p.key, &p.wrappedKey, &p.keyID, &start, &p.size); err != nil {
+			return nil, err
+		}
+		size := p.size
+		p.length = size
+		if start < offset {
+			p.offset = offset - start
+			p.length -= p.offset
+		}
+		if start+size > end {
+			p.length -= start + size - end
+		}
+		parts = append(parts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if length > 0 && len(parts) == 0 {
+		return nil, errors.New("chunk manifest is empty")
+	}
+	return &chunkReader{ctx: ctx, parts: parts}, nil
+}
+
+type chunkReader struct {
+	ctx   context.Context
+	parts []chunkPart
+	cur   io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.parts) == 0 {
+				return 0, io.EOF
+			}
+			part := r.parts[0]
+			r.parts = r.parts[1:]
+			rc, err := openBody(r.ctx, part.key, part.wrappedKey, part.keyID, part.hash, part.size, part.offset, part.length)
+			if err != nil {
+				return 0, err
+			}
+			r.cur = rc
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
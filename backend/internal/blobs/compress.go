@@ -0,0 +1,141 @@
+package blobs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"os"
+	"strings"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+)
+
+const (
+	// probeSize is how much of a blob is test-compressed when the MIME
+	// type does not settle the question.
+	probeSize = 64 << 10
+	// minCompressedRatio is the compressed/original ratio a blob must beat
+	// for the compressed copy to be kept.
+	minCompressedRatio = 0.9
+)
+
+// compressionEnabled reports whether new blobs may be compressed. It is on
+// unless COMPRESSION=off.
+func compressionEnabled() bool {
+	return os.Getenv("COMPRESSION") != "off"
+}
+
+// compressibleType classifies a MIME type: 1 means worth compressing, -1
+// means already compressed, 0 means probe the content.
+func compressibleType(mimeType string) int {
+	mt, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return 0
+	}
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"),
+		mt == "application/json", mt == "application/xml", mt == "application/javascript",
+		mt == "application/x-ndjson", mt == "application/csv", mt == "application/sql",
+		mt == "application/x-yaml", mt == "application/yaml":
+		return 1
+	case strings.HasPrefix(mt, "image/") && mt != "image/bmp" && mt != "image/x-icon",
+		strings.HasPrefix(mt, "video/"), strings.HasPrefix(mt, "audio/"),
+		mt == "application/zip", mt == "application/gzip", mt == "application/x-gzip",
+		mt == "application/x-7z-compressed", mt == "application/x-rar-compressed",
+		mt == "application/x-bzip2", mt == "application/x-xz", mt == "application/zstd",
+		strings.HasPrefix(mt, "application/vnd.openxmlformats-officedocument."):
+		return -1
+	}
+	return 0
+}
+
+// shouldCompress decides from the MIME type, or failing that from a test
+// compression of the first probeSize bytes.
+func shouldCompress(staged *storage.TempBlob, mimeType string) (bool, error) {
+	if !compressionEnabled() || staged.Size == 0 {
+		return false, nil
+	}
+	switch compressibleType(mimeType) {
+	case 1:
+		return true, nil
+	case -1:
+		return false, nil
+	}
+
+	r, err := staged.Rewind()
+	if err != nil {
+		return false, err
+	}
+	sample, err := io.ReadAll(io.LimitReader(r, probeSize))
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	zw.Write(sample)
+	zw.Close()
+	return float64(buf.Len()) < float64(len(sample))*minCompressedRatio, nil
+}
+
+// compress writes a gzip copy of the staged content to a new staging blob.
+// It returns nil when compression does not save enough to be worth it.
+func compress(staged *storage.TempBlob) (*storage.TempBlob, error) {
+	r, err := staged.Rewind()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	packed, err := storage.NewTempBlob(pr, -1)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	if float64(packed.Size) >= float64(staged.Size)*minCompressedRatio {
+		packed.Close()
+		return nil, nil
+	}
+	return packed, nil
+}
+
+// gzipReadCloser closes both the decompressor and the underlying body.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
+
+// decompress wraps a stored body and returns the requested range of the
+// original content. Compressed streams cannot seek, so the bytes before
+// offset are read and dropped.
+func decompress(body io.ReadCloser, offset, length int64) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	rc := &gzipReadCloser{Reader: zr, body: body}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, length), rc}, nil
+}
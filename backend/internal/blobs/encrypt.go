@@ -0,0 +1,104 @@
+package blobs
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/envelope"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+)
+
+// sealed is what encryptBody hands back: the data key wrapped for the
+// database and which master key wrapped it.
+type sealed struct {
+	wrappedKey []byte
+	keyID      string
+}
+
+// encryptBody writes an encrypted copy of body to a new staging blob under
+// a fresh data key wrapped for aad.
+func encryptBody(body *storage.TempBlob, aad string) (*storage.TempBlob, *sealed, error) {
+	dataKey, wrapped, keyID, err := newWrappedKey(aad)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := body.Rewind()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		ew, err := envelope.NewWriter(pw, dataKey)
+		if err == nil {
+			_, err = io.Copy(ew, r)
+			if cerr := ew.Close(); err == nil {
+				err = cerr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	enc, err := storage.NewTempBlob(pr, -1)
+	pr.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, &sealed{wrappedKey: wrapped, keyID: keyID}, nil
+}
+
+// encryptBytes is encryptBody for small in-memory bodies such as chunks.
+func encryptBytes(data []byte, aad string) ([]byte, *sealed, error) {
+	dataKey, wrapped, keyID, err := newWrappedKey(aad)
+	if err != nil {
+		return nil, nil, err
+	}
+	var buf bytes.Buffer
+	ew, err := envelope.NewWriter(&buf, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ew.Write(data)
+	if err := ew.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), &sealed{wrappedKey: wrapped, keyID: keyID}, nil
+}
+
+func newWrappedKey(aad string) (dataKey, wrapped []byte, keyID string, err error) {
+	dataKey, err = envelope.NewDataKey()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	wrapped, keyID, err = envelope.Keys.Wrap(dataKey, aad)
+	return dataKey, wrapped, keyID, err
+}
+
+// openBody reads [offset, offset+length) of a stored body holding plainSize
+// bytes before encryption. Bodies without a wrapped key are read as is.
+func openBody(ctx context.Context, ref string, wrappedKey []byte, keyID, aad string, plainSize, offset, length int64) (io.ReadCloser, error) {
+	store, key, err := storage.Resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if wrappedKey == nil {
+		if offset == 0 && length == plainSize {
+			return store.Get(ctx, key)
+		}
+		return store.GetRange(ctx, key, offset, length)
+	}
+
+	if envelope.Keys == nil {
+		return nil, envelope.ErrUnknownKey
+	}
+	dataKey, err := envelope.Keys.Unwrap(wrappedKey, keyID, aad)
+	if err != nil {
+		return nil, err
+	}
+	fetch := func(off, n int64) (io.ReadCloser, error) {
+		return store.GetRange(ctx, key, off, n)
+	}
+	return envelope.NewRangeReader(fetch, dataKey, plainSize, offset, length)
+}
@@ -0,0 +1,107 @@
+package blobs
+
+import (
+	"io"
+	"math/bits"
+)
+
+// Chunker splits a stream into content-defined chunks using FastCDC
+// (Xia et al., USENIX ATC '16) with normalized chunking. Boundaries depend
+// only on nearby bytes, so an edit inside a large file changes the chunks
+// around it and leaves the rest identical.
+type Chunker struct {
+	r                  io.Reader
+	buf                []byte
+	eof                bool
+	min, avg, max      int
+	maskSmall, maskBig uint64
+}
+
+// NewChunker returns a chunker producing chunks between min and max bytes
+// long and averaging about avg bytes. avg should be a power of two.
+func NewChunker(r io.Reader, min, avg, max int) *Chunker {
+	b := bits.Len(uint(avg)) - 1
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, 0, 2*max),
+		min: min, avg: avg, max: max,
+		// Harder to match below the average size, easier above it
+		maskSmall: highMask(b + 2),
+		maskBig:   highMask(b - 2),
+	}
+}
+
+// Next returns the next chunk, or io.EOF once the input is exhausted. The
+// returned slice is only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+	for !c.eof && len(c.buf) < c.max {
+		n, err := c.r.Read(c.buf[len(c.buf):cap(c.buf)])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf)
+	chunk := make([]byte, n)
+	copy(chunk, c.buf[:n])
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	return chunk, nil
+}
+
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskBig == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+func highMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// gear maps each byte to a fixed pseudo-random value. It must never change,
+// or stored chunks stop matching new uploads.
+var gear = func() (t [256]uint64) {
+	// splitmix64 with a constant seed
+	x := uint64(0x9E3779B97F4A7C15)
+	for i := range t {
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
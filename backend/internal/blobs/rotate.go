@@ -0,0 +1,91 @@
+package blobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/envelope"
+)
+
+// RotateKeys re-wraps every data key that is not wrapped by the current
+// master key. Bodies are left untouched. The retired master keys must still
+// be listed in ENCRYPTION_OLD_KEYS. It returns how many keys were
+// re-wrapped; rows it could not unwrap are logged and skipped.
+func RotateKeys(ctx context.Context) (int, error) {
+	if !envelope.Enabled() {
+		return 0, errors.New("encryption is not configured")
+	}
+
+	total := 0
+	for _, table := range []string{"blobs", "chunks"} {
+		n, err := rotateTable(ctx, table)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func rotateTable(ctx context.Context, table string) (int, error) {
+	const batch = 500
+	current := envelope.Keys.CurrentID()
+	rotated := 0
+	after := ""
+
+	for {
+		rows, err := db.DB.Query(ctx, fmt.Sprintf(`
+			SELECT hash, wrapped_key, key_id FROM %s
+			WHERE wrapped_key IS NOT NULL AND key_id <> $1 AND hash > $2
+			ORDER BY hash LIMIT %d`, table, batch),
+			current, after)
+		if err != nil {
+			return rotated, err
+		}
+
+		type row struct {
+			hash, keyID string
+			wrapped     []byte
+		}
+		var pending []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.hash, &r.wrapped, &r.keyID); err != nil {
+				rows.Close()
+				return rotated, err
+			}
+			pending = append(pending, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rotated, err
+		}
+		if len(pending) == 0 {
+			return rotated, nil
+		}
+
+		for _, r := range pending {
+			after = r.hash
+			dataKey, err := envelope.Keys.Unwrap(r.wrapped, r.keyID, r.hash)
+			if err != nil {
+				log.Printf("Cannot unwrap key for %s %s: %v", table, r.hash, err)
+				continue
+			}
+			wrapped, keyID, err := envelope.Keys.Wrap(dataKey, r.hash)
+			if err != nil {
+				return rotated, err
+			}
+			// Only replace the key we read, in case of a concurrent rotation
+			tag, err := db.DB.Exec(ctx, fmt.Sprintf(
+				"UPDATE %s SET wrapped_key=$1, key_id=$2 WHERE hash=$3 AND key_id=$4", table),
+				wrapped, keyID, r.hash, r.keyID)
+			if err != nil {
+				return rotated, err
+			}
+			rotated += int(tag.RowsAffected())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package blobs
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// NewReader returns a seekable reader over the blob's content. The body is
+// opened from the start right away, so a missing body is reported here
+// rather than halfway through a response. Seek only records the new
+// position; the next Read skips forward to it when it is close, or
+// reopens the body there through OpenRange. That keeps seeking cheap on
+// every backend, so http.ServeContent can answer Range requests without
+// knowing where the blob lives, and its probe of the size with SeekEnd
+// costs nothing.
+func (b *Blob) NewReader(ctx context.Context) (io.ReadSeekCloser, error) {
+	body, err := b.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &blobReader{ctx: ctx, blob: b, body: body}, nil
+}
+
+// maxSkip is how far ahead of the body a Read may be before it reopens the
+// body rather than reading through the gap.
+const maxSkip = 256 << 10
+
+type blobReader struct {
+	ctx     context.Context
+	blob    *Blob
+	offset  int64         // position Read continues from
+	body    io.ReadCloser // open at bodyPos, or nil
+	bodyPos int64
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.offset >= r.blob.Size {
+		return 0, io.EOF
+	}
+	if r.body != nil && r.offset != r.bodyPos {
+		gap := r.offset - r.bodyPos
+		if gap > 0 && gap <= maxSkip {
+			n, err := io.CopyN(io.Discard, r.body, gap)
+			r.bodyPos += n
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			r.Close()
+		}
+	}
+	if r.body == nil {
+		body, err := r.blob.OpenRange(r.ctx, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.bodyPos = body, r.offset
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	r.bodyPos += int64(n)
+	return n, err
+}
+
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.blob.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("blobs: negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *blobReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
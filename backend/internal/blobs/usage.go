@@ -0,0 +1,65 @@
+package blobs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/envelope"
+)
+
+// Usage is how a set of blobs takes up storage. Compression and encryption
+// are reported apart, so a compressed and encrypted body counts what
+// gzip saved and what the envelope added rather than their difference.
+type Usage struct {
+	Content            int64 // distinct content: whole blobs plus each distinct chunk
+	Stored             int64 // bytes in storage
+	CompressionSavings int64 // bytes gzip saved on compressed blobs
+	EncryptionOverhead int64 // bytes the envelope added to encrypted bodies
+}
+
+// CompressionPercent is the share of the content compression saved.
+func (u Usage) CompressionPercent() float64 {
+	if u.Content == 0 {
+		return 0
+	}
+	return float64(u.CompressionSavings) / float64(u.Content) * 100
+}
+
+// MeasureUsage sums the usage of the blobs whose hashes the query hashes
+// selects, numbered for args, or of every blob when hashes is empty.
+func MeasureUsage(ctx context.Context, q Querier, hashes string, args ...any) (Usage, error) {
+	in, chunkedIn := "", ""
+	if hashes != "" {
+		in = " AND hash IN (" + hashes + ")"
+		chunkedIn = " AND blobs.hash IN (" + hashes + ")"
+	}
+	// Every envelope segment carries a tag of the same size. Encrypted
+	// blobs record their ciphertext size, chunks their plaintext size.
+	tag := envelope.CiphertextSize(envelope.SegmentSize) - envelope.SegmentSize
+	seg := int64(envelope.SegmentSize)
+	blobOverhead := fmt.Sprintf("%d * GREATEST(1, (stored_size + %d) / %d)", tag, seg+tag-1, seg+tag)
+	chunkOverhead := fmt.Sprintf("%d * GREATEST(1, (size + %d) / %d)", tag, seg-1, seg)
+
+	var u Usage
+	err := q.QueryRow(ctx, `
+		WITH b AS (
+			SELECT size, stored_size, compression,
+			       CASE WHEN wrapped_key IS NOT NULL THEN `+blobOverhead+` ELSE 0 END AS overhead
+			FROM blobs WHERE NOT chunked`+in+`
+		), c AS (
+			SELECT ch.size, CASE WHEN ch.wrapped_key IS NOT NULL THEN `+chunkOverhead+` ELSE 0 END AS overhead
+			FROM chunks ch WHERE ch.hash IN (
+				SELECT bc.chunk_hash FROM blob_chunks bc JOIN blobs ON blobs.hash = bc.blob_hash
+				WHERE blobs.chunked`+chunkedIn+`)
+		)
+		SELECT COALESCE((SELECT SUM(size) FROM b), 0) + COALESCE((SELECT SUM(size) FROM c), 0),
+		       COALESCE((SELECT SUM(size - (stored_size - overhead)) FROM b WHERE compression <> ''), 0),
+		       COALESCE((SELECT SUM(overhead) FROM b), 0) + COALESCE((SELECT SUM(overhead) FROM c), 0)`,
+		args...,
+	).Scan(&u.Content, &u.CompressionSavings, &u.EncryptionOverhead)
+	if err != nil {
+		return Usage{}, err
+	}
+	u.Stored = u.Content - u.CompressionSavings + u.EncryptionOverhead
+	return u, nil
+}
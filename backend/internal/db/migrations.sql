@@ -46,3 +46,235 @@ SELECT
 WHERE NOT EXISTS (
     SELECT 1 FROM users WHERE username = 'admin1001'
 );
+
+--BLOB STORAGE: files.path holds a storage key relative to the backend root
+UPDATE files SET path = substring(path FROM 9) WHERE path LIKE 'uploads/%';
+
+--files.path records the backend holding the blob as "<backend>:<key>"
+UPDATE files SET path = 'local:' || path WHERE path NOT LIKE 'local:%' AND path NOT LIKE 's3:%';
+
+--BLOBS TABLE: one row per stored content object, shared by every user's
+--files row with the same hash (global deduplication)
+CREATE TABLE IF NOT EXISTS blobs (
+    hash VARCHAR(64) PRIMARY KEY,  -- SHA-256
+    size BIGINT NOT NULL,
+    storage_key TEXT NOT NULL,     -- "<backend>:<key>"
+    ref_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+--One-off data fixes run once, unlike the rest of this file which runs on
+--every start
+CREATE TABLE IF NOT EXISTS schema_backfills (
+    name VARCHAR(64) PRIMARY KEY,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+--Every files and file_versions row holds one reference to its blob. This
+--also repairs counts left without their versions by earlier releases.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM schema_backfills WHERE name = 'blobs_ref_count') THEN
+        INSERT INTO blobs (hash, size, storage_key)
+        SELECT DISTINCT ON (hash) hash, size, path FROM files WHERE path IS NOT NULL ORDER BY hash, id
+        ON CONFLICT (hash) DO NOTHING;
+
+        UPDATE blobs b SET ref_count = (SELECT COUNT(*) FROM files f WHERE f.hash = b.hash);
+        IF to_regclass('file_versions') IS NOT NULL THEN
+            UPDATE blobs b SET ref_count = ref_count + (SELECT COUNT(*) FROM file_versions v WHERE v.hash = b.hash);
+        END IF;
+
+        INSERT INTO schema_backfills (name) VALUES ('blobs_ref_count');
+    END IF;
+END $$;
+
+--files rows are user-owned references; the storage key lives on blobs
+ALTER TABLE files ALTER COLUMN path DROP NOT NULL;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'files_hash_fkey') THEN
+        ALTER TABLE files ADD CONSTRAINT files_hash_fkey FOREIGN KEY (hash) REFERENCES blobs(hash);
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_files_hash ON files(hash);
+
+--RESUMABLE (tus) UPLOAD SESSIONS
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id VARCHAR(32) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    mime_type VARCHAR(100) NOT NULL DEFAULT '',
+    length BIGINT NOT NULL,
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    hash_state BYTEA,             -- marshalled SHA-256 state up to upload_offset
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+--CHUNK-LEVEL DEDUPLICATION: large blobs can be stored as a manifest of
+--content-defined chunks shared between blobs
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS chunked BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS chunks (
+    hash VARCHAR(64) PRIMARY KEY,  -- SHA-256 of the chunk
+    size INT NOT NULL,
+    storage_key TEXT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS blob_chunks (
+    blob_hash VARCHAR(64) NOT NULL REFERENCES blobs(hash) ON DELETE CASCADE,
+    seq INT NOT NULL,
+    chunk_hash VARCHAR(64) NOT NULL REFERENCES chunks(hash),
+    chunk_offset BIGINT NOT NULL,
+    size INT NOT NULL,
+    PRIMARY KEY (blob_hash, seq)
+);
+
+CREATE INDEX IF NOT EXISTS idx_blob_chunks_chunk ON blob_chunks(chunk_hash);
+
+--BLOB COMPRESSION: size is the logical size, stored_size what the body
+--takes up in storage
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS compression VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS stored_size BIGINT;
+UPDATE blobs SET stored_size = CASE WHEN chunked THEN 0 ELSE size END WHERE stored_size IS NULL;
+ALTER TABLE blobs ALTER COLUMN stored_size SET NOT NULL;
+
+--ENCRYPTION AT REST: per-body data key, wrapped by the master key key_id
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS key_id VARCHAR(16);
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS key_id VARCHAR(16);
+
+--GARBAGE COLLECTION: set when the collector cannot find a row's body
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS missing_since TIMESTAMP;
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS missing_since TIMESTAMP;
+
+--INTEGRITY SCRUBBING: result of re-hashing each blob's content
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS integrity VARCHAR(10) NOT NULL DEFAULT '';
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS verified_at TIMESTAMP;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS integrity_error TEXT;
+CREATE INDEX IF NOT EXISTS idx_blobs_verified_at ON blobs(verified_at NULLS FIRST);
+
+--AUTHENTICATED DOWNLOADS: counted apart from public downloads
+ALTER TABLE files ADD COLUMN IF NOT EXISTS owner_download_count INT NOT NULL DEFAULT 0;
+
+--SHARE LINKS: unguessable, expiring links to a single file
+CREATE TABLE IF NOT EXISTS share_links (
+    id SERIAL PRIMARY KEY,
+    token VARCHAR(64) UNIQUE NOT NULL,
+    file_id INT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    created_by INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    password_hash TEXT,                 -- bcrypt, NULL when no password is set
+    expires_at TIMESTAMP NOT NULL,
+    max_downloads INT,                  -- NULL means unlimited
+    download_count INT NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_share_links_file ON share_links(file_id);
+
+--FILE GRANTS: files shared with individual users
+CREATE TABLE IF NOT EXISTS file_grants (
+    file_id INT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('viewer', 'editor', 'co-owner')),
+    granted_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (file_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_grants_user ON file_grants(user_id);
+
+--GROUPS: shared spaces whose files are charged to a pooled quota.
+--storage_quota is the remaining space, like users.storage_quota
+CREATE TABLE IF NOT EXISTS groups (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) UNIQUE NOT NULL,
+    storage_quota BIGINT NOT NULL DEFAULT 104857600,
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id INT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('viewer', 'member', 'admin')),
+    joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_members_user ON group_members(user_id);
+
+--Group-owned files keep the uploader in user_id
+ALTER TABLE files ADD COLUMN IF NOT EXISTS group_id INT REFERENCES groups(id);
+CREATE INDEX IF NOT EXISTS idx_files_group ON files(group_id);
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS group_id INT REFERENCES groups(id) ON DELETE CASCADE;
+
+CREATE TABLE IF NOT EXISTS group_grants (
+    file_id INT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    group_id INT NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('viewer', 'editor', 'co-owner')),
+    granted_by INT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (file_id, group_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_group_grants_group ON group_grants(group_id);
+
+--FOLDERS: a tree per user, and one per group for group files
+CREATE TABLE IF NOT EXISTS folders (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    group_id INT REFERENCES groups(id) ON DELETE CASCADE,
+    parent_id INT REFERENCES folders(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_user_name
+    ON folders(user_id, COALESCE(parent_id, 0), name) WHERE group_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_group_name
+    ON folders(group_id, COALESCE(parent_id, 0), name) WHERE group_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_folders_parent ON folders(parent_id);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS folder_id INT REFERENCES folders(id);
+CREATE INDEX IF NOT EXISTS idx_files_folder ON files(folder_id);
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS folder_id INT REFERENCES folders(id) ON DELETE CASCADE;
+
+--FILE VERSIONS: earlier contents of a file, oldest pruned past its retention
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version_retention INT; -- NULL uses FILE_VERSION_RETENTION
+
+CREATE TABLE IF NOT EXISTS file_versions (
+    id SERIAL PRIMARY KEY,
+    file_id INT NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    version INT NOT NULL,
+    hash VARCHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    mime_type VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    UNIQUE (file_id, version)
+);
+
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS version_of INT REFERENCES files(id) ON DELETE CASCADE;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS tags TEXT[];
+
+--TRASH: deleted files are kept, still charged, until purged
+ALTER TABLE files ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS deleted_by INT REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL;
+
+--FULL-TEXT SEARCH: text extracted from documents, one row per blob
+CREATE TABLE IF NOT EXISTS blob_text (
+    hash VARCHAR(64) PRIMARY KEY REFERENCES blobs(hash) ON DELETE CASCADE,
+    body TEXT NOT NULL DEFAULT '',
+    tsv TSVECTOR NOT NULL,
+    status VARCHAR(12) NOT NULL, -- ok, unsupported, skipped or failed
+    error TEXT,
+    extracted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_blob_text_tsv ON blob_text USING GIN (tsv);
@@ -0,0 +1,152 @@
+// Package envelope implements encryption at rest for blob bodies. Every
+// body gets its own random AES-256 data key; the data key is stored wrapped
+// (encrypted) by a master key, so rotating the master key only means
+// re-wrapping data keys, never re-encrypting bodies.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnknownKey is returned when a data key was wrapped by a master key that
+// is not configured.
+var ErrUnknownKey = errors.New("unknown master key")
+
+// Keyring holds the master key used to wrap new data keys and any older
+// master keys still needed to unwrap existing ones.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// Keys is the configured keyring, or nil when encryption is disabled.
+var Keys *Keyring
+
+// Init loads the master key from ENCRYPTION_KEY or ENCRYPTION_KEY_FILE
+// (32 bytes, hex or base64 encoded) and retired keys from
+// ENCRYPTION_OLD_KEYS (comma separated, same encoding). Without a master
+// key encryption stays disabled.
+func Init() error {
+	encoded := os.Getenv("ENCRYPTION_KEY")
+	if path := os.Getenv("ENCRYPTION_KEY_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		encoded = string(b)
+	}
+	if strings.TrimSpace(encoded) == "" {
+		return nil
+	}
+
+	ring := &Keyring{keys: map[string]cipher.AEAD{}}
+	id, err := ring.add(encoded)
+	if err != nil {
+		return fmt.Errorf("ENCRYPTION_KEY: %w", err)
+	}
+	ring.current = id
+
+	for _, old := range strings.Split(os.Getenv("ENCRYPTION_OLD_KEYS"), ",") {
+		if strings.TrimSpace(old) == "" {
+			continue
+		}
+		if _, err := ring.add(old); err != nil {
+			return fmt.Errorf("ENCRYPTION_OLD_KEYS: %w", err)
+		}
+	}
+
+	Keys = ring
+	fmt.Println("Encryption at rest enabled, master key", id)
+	return nil
+}
+
+// Enabled reports whether new bodies should be encrypted.
+func Enabled() bool {
+	return Keys != nil
+}
+
+func (k *Keyring) add(encoded string) (string, error) {
+	key, err := decodeKey(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	id := keyID(key)
+	k.keys[id] = aead
+	return id, nil
+}
+
+// CurrentID identifies the master key new data keys are wrapped with.
+func (k *Keyring) CurrentID() string {
+	return k.current
+}
+
+// NewDataKey returns a fresh random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Wrap encrypts a data key with the current master key. aad binds the
+// wrapped key to what it protects (the content hash), so it cannot be
+// moved to another row.
+func (k *Keyring) Wrap(dataKey []byte, aad string) (wrapped []byte, keyID string, err error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(aad)), k.current, nil
+}
+
+// Unwrap decrypts a data key wrapped by the master key keyID.
+func (k *Keyring) Unwrap(wrapped []byte, keyID, aad string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownKey, keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, []byte(aad))
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, errors.New("master key must be 32 bytes, hex or base64 encoded")
+}
+
+// keyID is a short public fingerprint of a master key.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("filevault-master-key:"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,186 @@
+package envelope
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Bodies are encrypted as a sequence of AES-GCM segments of SegmentSize
+// plaintext bytes, each with its own tag. The nonce is the segment number
+// plus a flag marking the final segment, which stops segments from being
+// reordered or the body from being truncated. Since every data key
+// encrypts exactly one body, counter nonces never repeat. Fixed size
+// segments also make any plaintext range readable without decrypting what
+// comes before it.
+const (
+	SegmentSize = 64 << 10
+	tagSize     = 16
+)
+
+// ErrCorrupt is returned when a segment fails authentication.
+var ErrCorrupt = errors.New("encrypted body is corrupt or truncated")
+
+func segmentNonce(n int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(n))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func segments(plainSize int64) int64 {
+	if plainSize == 0 {
+		return 1
+	}
+	return (plainSize + SegmentSize - 1) / SegmentSize
+}
+
+// CiphertextSize is the stored size of a body of plainSize bytes.
+func CiphertextSize(plainSize int64) int64 {
+	return plainSize + segments(plainSize)*tagSize
+}
+
+// PlaintextSize reverses CiphertextSize.
+func PlaintextSize(cipherSize int64) int64 {
+	n := (cipherSize + SegmentSize + tagSize - 1) / (SegmentSize + tagSize)
+	if n == 0 {
+		n = 1
+	}
+	return cipherSize - n*tagSize
+}
+
+type writer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    int64
+}
+
+// NewWriter encrypts everything written to it with dataKey and writes the
+// result to w. Close must be called to write the final segment.
+func NewWriter(w io.Writer, dataKey []byte) (io.WriteCloser, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{w: w, aead: aead, buf: make([]byte, 0, SegmentSize)}, nil
+}
+
+func (e *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Only seal a full segment once more data shows it is not the last
+		if len(e.buf) == SegmentSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):SegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *writer) flush(last bool) error {
+	sealed := e.aead.Seal(nil, segmentNonce(e.n, last), e.buf, nil)
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *writer) Close() error {
+	return e.flush(true)
+}
+
+// Fetcher reads length bytes of stored ciphertext starting at offset.
+type Fetcher func(offset, length int64) (io.ReadCloser, error)
+
+// NewRangeReader decrypts [offset, offset+length) of a body whose plaintext
+// is plainSize bytes, fetching only the segments that cover the range.
+func NewRangeReader(fetch Fetcher, dataKey []byte, plainSize, offset, length int64) (io.ReadCloser, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 || offset+length > plainSize {
+		length = plainSize - offset
+	}
+
+	first := offset / SegmentSize
+	last := segments(plainSize) - 1
+	if length > 0 {
+		last = (offset + length - 1) / SegmentSize
+	}
+	start := first * (SegmentSize + tagSize)
+	end := (last + 1) * (SegmentSize + tagSize)
+	if total := CiphertextSize(plainSize); end > total {
+		end = total
+	}
+
+	body, err := fetch(start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	return &rangeReader{
+		body:    body,
+		aead:    aead,
+		seg:     first,
+		lastSeg: segments(plainSize) - 1,
+		skip:    offset - first*SegmentSize,
+		left:    length,
+		sealed:  make([]byte, SegmentSize+tagSize),
+	}, nil
+}
+
+type rangeReader struct {
+	body    io.ReadCloser
+	aead    cipher.AEAD
+	seg     int64 // next segment to decrypt
+	lastSeg int64
+	skip    int64 // plaintext bytes to drop from the next segment
+	left    int64 // plaintext bytes still to return
+	plain   []byte
+	sealed  []byte
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.left == 0 {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(r.body, r.sealed)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			if r.seg != r.lastSeg {
+				return 0, ErrCorrupt
+			}
+		} else if err != nil {
+			return 0, err
+		}
+		plain, err := r.aead.Open(r.sealed[:0:0], segmentNonce(r.seg, r.seg == r.lastSeg), r.sealed[:n], nil)
+		if err != nil {
+			return 0, ErrCorrupt
+		}
+		r.seg++
+		plain = plain[r.skip:]
+		r.skip = 0
+		if int64(len(plain)) > r.left {
+			plain = plain[:r.left]
+		}
+		r.plain = plain
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	r.left -= int64(n)
+	return n, nil
+}
+
+func (r *rangeReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,196 @@
+package extract
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxRange caps how many codes one bfrange line may map, so a hostile
+// CMap cannot make us build a map of billions of entries.
+const maxRange = 1 << 16
+
+// cmap is a font's ToUnicode map: which text each character code stands
+// for. Codes are one to four bytes long, as the codespace ranges say.
+type cmap struct {
+	widths []int             // code lengths in bytes, shortest first
+	codes  map[string]string // code bytes to text
+}
+
+// cmapToken is a hex string, or a word such as an operator or bracket.
+type cmapToken struct {
+	hex   []byte
+	word  string
+	isHex bool
+}
+
+// parseCMap reads the codespacerange, bfchar and bfrange sections of a
+// ToUnicode CMap. It returns nil when the map has no mappings.
+func parseCMap(c []byte) *cmap {
+	cm := &cmap{codes: map[string]string{}}
+	widths := map[int]bool{}
+	toks := cmapTokens(c)
+	for i := 0; i < len(toks); i++ {
+		switch toks[i].word {
+		case "begincodespacerange":
+			for i++; i+1 < len(toks) && toks[i].isHex && toks[i+1].isHex; i += 2 {
+				widths[len(toks[i].hex)] = true
+			}
+		case "beginbfchar":
+			for i++; i+1 < len(toks) && toks[i].isHex; i += 2 {
+				if toks[i+1].isHex {
+					cm.codes[string(toks[i].hex)] = utf16BE(toks[i+1].hex)
+				}
+			}
+		case "beginbfrange":
+			for i++; i+2 < len(toks) && toks[i].isHex && toks[i+1].isHex; {
+				lo, hi := toks[i].hex, toks[i+1].hex
+				i += 2
+				switch {
+				case toks[i].isHex:
+					dst := toks[i].hex
+					cm.addRange(lo, hi, func(k int) string { return utf16BE(offsetUTF16(dst, k)) })
+					i++
+				case toks[i].word == "[":
+					var dsts []string
+					for i++; i < len(toks) && toks[i].word != "]"; i++ {
+						dsts = append(dsts, utf16BE(toks[i].hex))
+					}
+					i++
+					cm.addRange(lo, hi, func(k int) string {
+						if k < len(dsts) {
+							return dsts[k]
+						}
+						return ""
+					})
+				default:
+					i++
+				}
+			}
+		}
+	}
+	if len(cm.codes) == 0 {
+		return nil
+	}
+
+	// Without codespace ranges, the mapped codes show how long they are
+	if len(widths) == 0 {
+		for code := range cm.codes {
+			widths[len(code)] = true
+		}
+	}
+	for w := range widths {
+		if w >= 1 && w <= 4 {
+			cm.widths = append(cm.widths, w)
+		}
+	}
+	if len(cm.widths) == 0 {
+		cm.widths = []int{1}
+	}
+	sort.Ints(cm.widths)
+	return cm
+}
+
+// addRange maps the codes from lo to hi, both as long as lo, to text(k)
+// for the k-th code.
+func (cm *cmap) addRange(lo, hi []byte, text func(k int) string) {
+	if len(lo) == 0 || len(lo) > 4 || len(hi) != len(lo) {
+		return
+	}
+	first, last := codeValue(lo), codeValue(hi)
+	if last < first || last-first >= maxRange {
+		return
+	}
+	code := make([]byte, len(lo))
+	for k := 0; k <= int(last-first); k++ {
+		v := first + uint32(k)
+		for j := len(code) - 1; j >= 0; j-- {
+			code[j] = byte(v)
+			v >>= 8
+		}
+		if t := text(k); t != "" {
+			cm.codes[string(code)] = t
+		}
+	}
+}
+
+// decode turns the codes of a shown string into text. At each position the
+// shortest code with a mapping wins; unmapped codes are dropped.
+func (cm *cmap) decode(s []byte) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		n := 0
+		for _, w := range cm.widths {
+			if i+w > len(s) {
+				break
+			}
+			if t, ok := cm.codes[string(s[i:i+w])]; ok {
+				b.WriteString(t)
+				n = w
+				break
+			}
+		}
+		if n == 0 {
+			n = cm.widths[0]
+		}
+		i += n
+	}
+	return b.String()
+}
+
+func codeValue(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// offsetUTF16 adds k to the last UTF-16 code unit of dst, which is how a
+// bfrange with a single destination maps the codes after the first.
+func offsetUTF16(dst []byte, k int) []byte {
+	out := append([]byte(nil), dst...)
+	if len(out) < 2 {
+		return out
+	}
+	n := len(out)
+	v := uint16(out[n-2])<<8 | uint16(out[n-1]) + uint16(k)
+	out[n-2], out[n-1] = byte(v>>8), byte(v)
+	return out
+}
+
+// cmapTokens splits a CMap into hex strings and words, skipping comments
+// and dictionaries' delimiters.
+func cmapTokens(c []byte) []cmapToken {
+	var toks []cmapToken
+	for i := 0; i < len(c); {
+		ch := c[i]
+		switch {
+		case ch == '%':
+			for i < len(c) && c[i] != '\n' && c[i] != '\r' {
+				i++
+			}
+		case ch == '<' && i+1 < len(c) && c[i+1] == '<', ch == '>' && i+1 < len(c) && c[i+1] == '>':
+			i += 2
+		case ch == '<':
+			s, n := hexString(c[i:])
+			toks = append(toks, cmapToken{hex: s, isHex: true})
+			i += n
+		case ch == '[' || ch == ']':
+			toks = append(toks, cmapToken{word: string(ch)})
+			i++
+		case ch == '(':
+			_, n := literalString(c[i:])
+			i += n
+		case isWhite(ch) || isDelimiter(ch):
+			i++
+		default:
+			j := i
+			for j < len(c) && !isDelimiter(c[j]) && !isWhite(c[j]) {
+				j++
+			}
+			toks = append(toks, cmapToken{word: string(c[i:j])})
+			i = j
+		}
+	}
+	return toks
+}
@@ -0,0 +1,84 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// maxDocxSize caps how much of a DOCX file is read into memory, and
+// maxDocumentXML how much of its unpacked document part is parsed.
+const (
+	maxDocxSize    = 64 << 20
+	maxDocumentXML = 64 << 20
+)
+
+// docxText reads the paragraphs of a Word document's main part.
+func docxText(r io.Reader, size int64) (string, error) {
+	if size > maxDocxSize {
+		return "", errors.New("document too large to extract")
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxDocxSize))
+	if err != nil {
+		return "", err
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range zr.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		return wordText(io.LimitReader(rc, maxDocumentXML))
+	}
+	return "", errors.New("not a Word document")
+}
+
+// wordText collects the w:t runs of WordprocessingML, one line per
+// paragraph.
+func wordText(r io.Reader) (string, error) {
+	var out strings.Builder
+	dec := xml.NewDecoder(r)
+	inText := false
+	for out.Len() < maxTextSize {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				out.WriteByte('\t')
+			case "br", "cr":
+				out.WriteByte('\n')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				out.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				out.Write(t)
+			}
+		}
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,113 @@
+// Package extract pulls the text out of uploaded documents so they can be
+// found by what they say. Plain text, Markdown, CSV, HTML, PDF and DOCX are
+// understood; the text is stored with a tsvector per blob, shared by every
+// file with that content, and filled in by background workers after the
+// upload has committed.
+package extract
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Config is the text search configuration documents are indexed and
+// queried with.
+const Config = "english"
+
+// maxTextSize caps the stored text, keeping the tsvector well within
+// PostgreSQL's 1 MB limit.
+const maxTextSize = 512 << 10
+
+// ErrUnsupported is returned for content no extractor understands.
+var ErrUnsupported = errors.New("unsupported content type")
+
+// extractor reads a document and returns its text. size is the length of
+// the content.
+type extractor func(r io.Reader, size int64) (string, error)
+
+// Supported reports whether content with this MIME type or file name can
+// be extracted.
+func Supported(mimeType, filename string) bool {
+	return lookup(mimeType, filename) != nil
+}
+
+// Extract returns the text of a document, cleaned up for indexing.
+func Extract(r io.Reader, size int64, mimeType, filename string) (string, error) {
+	ex := lookup(mimeType, filename)
+	if ex == nil {
+		return "", ErrUnsupported
+	}
+	text, err := ex(r, size)
+	if err != nil {
+		return "", err
+	}
+	return clean(text), nil
+}
+
+// lookup picks an extractor by MIME type, falling back to the file
+// extension for generic types like application/octet-stream.
+func lookup(mimeType, filename string) extractor {
+	mt, _, _ := mime.ParseMediaType(mimeType)
+	switch mt {
+	case "text/plain", "text/markdown", "text/x-markdown", "text/csv", "application/csv":
+		return plainText
+	case "text/html", "application/xhtml+xml":
+		return htmlText
+	case "application/pdf":
+		return pdfText
+	case "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		return docxText
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".txt", ".text", ".md", ".markdown", ".csv":
+		return plainText
+	case ".html", ".htm", ".xhtml":
+		return htmlText
+	case ".pdf":
+		return pdfText
+	case ".docx":
+		return docxText
+	}
+	return nil
+}
+
+func plainText(r io.Reader, _ int64) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxTextSize))
+	return string(b), err
+}
+
+// clean makes text safe to store and index: valid UTF-8 without NULs or
+// other control characters, runs of blank space squeezed to one space or
+// newline, and capped at maxTextSize.
+func clean(text string) string {
+	var b strings.Builder
+	var sep rune
+	for _, r := range strings.ToValidUTF8(text, "") {
+		if unicode.IsSpace(r) {
+			if r == '\n' || sep == 0 {
+				sep = ' '
+				if r == '\n' {
+					sep = '\n'
+				}
+			}
+			continue
+		}
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			continue
+		}
+		if b.Len() >= maxTextSize {
+			break
+		}
+		if sep != 0 && b.Len() > 0 {
+			b.WriteRune(sep)
+		}
+		sep = 0
+		b.WriteRune(r)
+	}
+	return b.String()
+}
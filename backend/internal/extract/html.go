@@ -0,0 +1,82 @@
+package extract
+
+import (
+	"html"
+	"io"
+	"strings"
+)
+
+// htmlText strips markup from an HTML document, dropping scripts, styles
+// and comments, and decodes entities.
+func htmlText(r io.Reader, _ int64) (string, error) {
+	b, err := io.ReadAll(io.LimitReader(r, 4*maxTextSize))
+	if err != nil {
+		return "", err
+	}
+	return stripTags(string(b)), nil
+}
+
+func stripTags(doc string) string {
+	var out strings.Builder
+	for len(doc) > 0 {
+		i := strings.IndexByte(doc, '<')
+		if i < 0 {
+			out.WriteString(html.UnescapeString(doc))
+			break
+		}
+		out.WriteString(html.UnescapeString(doc[:i]))
+		doc = doc[i:]
+
+		if strings.HasPrefix(doc, "<!--") {
+			end := strings.Index(doc, "-->")
+			if end < 0 {
+				break
+			}
+			doc = doc[end+3:]
+			continue
+		}
+
+		end := strings.IndexByte(doc, '>')
+		if end < 0 {
+			break
+		}
+		name := tagName(doc[1:end])
+		doc = doc[end+1:]
+		// Tags separate words; block level ones would ideally be lines
+		out.WriteByte(' ')
+
+		if name == "script" || name == "style" {
+			close := indexFold(doc, "</"+name)
+			if close < 0 {
+				break
+			}
+			doc = doc[close:]
+		}
+	}
+	return out.String()
+}
+
+// indexFold is strings.Index ignoring ASCII case. Lowering doc first
+// would not do: that can change its length, so the index would not fit
+// doc.
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// tagName returns the lower-cased element name of a tag's contents, e.g.
+// "script" for `script type="x"`.
+func tagName(tag string) string {
+	end := strings.IndexAny(tag, " \t\r\n/>")
+	if end == 0 && strings.HasPrefix(tag, "/") {
+		return ""
+	}
+	if end < 0 {
+		end = len(tag)
+	}
+	return strings.ToLower(tag[:end])
+}
@@ -0,0 +1,518 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxPDFSize caps how much of a PDF is read into memory, and maxInflated
+// how much its streams may decompress to in total.
+const (
+	maxPDFSize  = 64 << 20
+	maxInflated = 64 << 20
+)
+
+// wordGap is how far back, in thousandths of a text unit, a TJ adjustment
+// must move for it to count as a space between words.
+const wordGap = -200
+
+// pdfText collects the text drawn by a PDF's content streams. Strings in
+// fonts with a ToUnicode map, as most CID fonts have, are decoded through
+// it; other fonts are taken to use Latin-1 or UTF-16 codes, which holds
+// for most simple fonts.
+func pdfText(r io.Reader, size int64) (string, error) {
+	if size > maxPDFSize {
+		return "", errors.New("document too large to extract")
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxPDFSize))
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", errors.New("not a PDF document")
+	}
+
+	d := parsePDF(data)
+	var out strings.Builder
+	for _, o := range d.order {
+		if out.Len() >= maxTextSize {
+			break
+		}
+		if o.stream != nil && bytes.Contains(o.stream, []byte("BT")) {
+			showText(o.stream, d.fontsFor(o), &out)
+		}
+	}
+	return out.String(), nil
+}
+
+var (
+	objHeader  = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+	refPattern = regexp.MustCompile(`(\d+)\s+\d+\s+R\b`)
+	leadingRef = regexp.MustCompile(`^(\d+)\s+\d+\s+R\b`)
+	fontEntry  = regexp.MustCompile(`/([^\s/<>\[\]()%]+)\s+(\d+)\s+\d+\s+R\b`)
+	pageType   = regexp.MustCompile(`/Type\s*/Page[^a-zA-Z]`)
+	imageType  = regexp.MustCompile(`/Subtype\s*/Image\b`)
+	objStmType = regexp.MustCompile(`/Type\s*/ObjStm\b`)
+)
+
+// pdfObject is an indirect object: its dictionary, or its whole value when
+// it has no stream, and its stream decoded, or nil when it has none or it
+// cannot be decoded.
+type pdfObject struct {
+	dict   []byte
+	stream []byte
+}
+
+// pdfDoc is a document's objects, found by scanning for them rather than
+// through the cross-reference table, so damaged files still give up what
+// they can.
+type pdfDoc struct {
+	objects map[int]*pdfObject
+	order   []*pdfObject // objects with streams, in file order
+	budget  int64        // bytes streams may still inflate to
+
+	cmaps    map[int]*cmap                   // ToUnicode maps by font object
+	contents map[*pdfObject]map[string]*cmap // fonts of each page's content streams
+	all      map[string]*cmap                // every page's fonts, for streams of no known page
+}
+
+func parsePDF(data []byte) *pdfDoc {
+	d := &pdfDoc{
+		objects:  map[int]*pdfObject{},
+		budget:   maxInflated,
+		cmaps:    map[int]*cmap{},
+		contents: map[*pdfObject]map[string]*cmap{},
+		all:      map[string]*cmap{},
+	}
+
+	consumed := 0
+	for _, loc := range objHeader.FindAllSubmatchIndex(data, -1) {
+		// A header inside an earlier object's stream is binary noise
+		if loc[0] < consumed {
+			continue
+		}
+		num, _ := strconv.Atoi(string(data[loc[2]:loc[3]]))
+		body := data[loc[1]:]
+		o := &pdfObject{}
+		end := bytes.Index(body, []byte("endobj"))
+		st := bytes.Index(body, []byte("stream"))
+		if st >= 0 && (end < 0 || st < end) {
+			o.dict = body[:st]
+			raw := body[st+len("stream"):]
+			if len(raw) > 0 && raw[0] == '\r' {
+				raw = raw[1:]
+			}
+			if len(raw) > 0 && raw[0] == '\n' {
+				raw = raw[1:]
+			}
+			n := bytes.Index(raw, []byte("endstream"))
+			if n < 0 {
+				break
+			}
+			o.stream = d.decode(o.dict, raw[:n])
+			consumed = len(data) - len(raw) + n + len("endstream")
+			d.order = append(d.order, o)
+		} else {
+			if end < 0 {
+				end = len(body)
+			}
+			o.dict = body[:end]
+			consumed = loc[1] + end
+		}
+		d.objects[num] = o
+	}
+
+	// Objects packed into object streams, where fonts often are
+	for _, o := range d.order {
+		if o.stream != nil && objStmType.Match(o.dict) {
+			d.unpack(o)
+		}
+	}
+	for _, o := range d.objects {
+		if pageType.Match(o.dict) {
+			d.addPage(o.dict)
+		}
+	}
+	return d
+}
+
+// decode returns a stream's content, or nil for images and filters other
+// than Flate.
+func (d *pdfDoc) decode(dict, raw []byte) []byte {
+	switch {
+	case imageType.Match(dict):
+		return nil
+	case bytes.Contains(dict, []byte("/FlateDecode")):
+		if d.budget <= 0 {
+			return nil
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil
+		}
+		// A stream cut short still gives up what it holds
+		content, _ := io.ReadAll(io.LimitReader(zr, d.budget))
+		zr.Close()
+		d.budget -= int64(len(content))
+		return content
+	case bytes.Contains(dict, []byte("/Filter")):
+		return nil
+	}
+	return raw
+}
+
+// unpack adds the objects held by an object stream: /N pairs of object
+// number and offset, relative to /First, followed by the objects.
+func (d *pdfDoc) unpack(o *pdfObject) {
+	n, first := intValue(o.dict, "N"), intValue(o.dict, "First")
+	if n <= 0 || first <= 0 || first > len(o.stream) {
+		return
+	}
+	header := strings.Fields(string(o.stream[:first]))
+	for k := 0; k < n && 2*k+1 < len(header); k++ {
+		num, err1 := strconv.Atoi(header[2*k])
+		off, err2 := strconv.Atoi(header[2*k+1])
+		if err1 != nil || err2 != nil || first+off > len(o.stream) {
+			return
+		}
+		end := len(o.stream)
+		if 2*k+3 < len(header) {
+			if next, err := strconv.Atoi(header[2*k+3]); err == nil && first+next >= first+off && first+next <= end {
+				end = first + next
+			}
+		}
+		if _, ok := d.objects[num]; !ok {
+			d.objects[num] = &pdfObject{dict: o.stream[first+off : end]}
+		}
+	}
+}
+
+// addPage records the fonts of a page for its content streams. Resources
+// missing from the page are inherited from the page tree.
+func (d *pdfDoc) addPage(page []byte) {
+	res := dictValue(page, "Resources")
+	for depth := 0; res == nil && depth < 32; depth++ {
+		parent := d.resolve(dictValue(page, "Parent"))
+		if parent == nil {
+			break
+		}
+		page = parent
+		res = dictValue(page, "Resources")
+	}
+	fonts := d.fonts(d.resolve(res))
+
+	contents := dictValue(page, "Contents")
+	if bytes.HasPrefix(contents, []byte("[")) {
+		if end := bytes.IndexByte(contents, ']'); end >= 0 {
+			contents = contents[:end]
+		}
+	} else if m := leadingRef.Find(contents); m != nil {
+		contents = m
+	} else {
+		contents = nil
+	}
+	for _, m := range refPattern.FindAllSubmatch(contents, -1) {
+		num, _ := strconv.Atoi(string(m[1]))
+		if o := d.objects[num]; o != nil {
+			d.contents[o] = fonts
+		}
+	}
+	for name, cm := range fonts {
+		if _, ok := d.all[name]; !ok {
+			d.all[name] = cm
+		}
+	}
+}
+
+// fonts maps the font names of a resource dictionary to their ToUnicode
+// maps, leaving out fonts without one.
+func (d *pdfDoc) fonts(resources []byte) map[string]*cmap {
+	fonts := map[string]*cmap{}
+	for _, m := range fontEntry.FindAllSubmatch(d.resolve(dictValue(resources, "Font")), -1) {
+		num, _ := strconv.Atoi(string(m[2]))
+		if cm := d.toUnicode(num); cm != nil {
+			fonts[string(m[1])] = cm
+		}
+	}
+	return fonts
+}
+
+func (d *pdfDoc) toUnicode(font int) *cmap {
+	if cm, ok := d.cmaps[font]; ok {
+		return cm
+	}
+	var cm *cmap
+	if o := d.objects[font]; o != nil {
+		if m := d.resolveObject(dictValue(o.dict, "ToUnicode")); m != nil && m.stream != nil {
+			cm = parseCMap(m.stream)
+		}
+	}
+	d.cmaps[font] = cm
+	return cm
+}
+
+// fontsFor returns the fonts a content stream draws with: its own
+// resources if it is a form, else its page's, else those of any page.
+func (d *pdfDoc) fontsFor(o *pdfObject) map[string]*cmap {
+	if res := dictValue(o.dict, "Resources"); res != nil {
+		return d.fonts(d.resolve(res))
+	}
+	if fonts, ok := d.contents[o]; ok {
+		return fonts
+	}
+	return d.all
+}
+
+// resolve returns the dictionary a value stands for: the value itself when
+// it is a dictionary, or the object it refers to.
+func (d *pdfDoc) resolve(v []byte) []byte {
+	if bytes.HasPrefix(v, []byte("<<")) {
+		return v
+	}
+	if o := d.resolveObject(v); o != nil {
+		return o.dict
+	}
+	return nil
+}
+
+func (d *pdfDoc) resolveObject(v []byte) *pdfObject {
+	m := leadingRef.FindSubmatch(v)
+	if m == nil {
+		return nil
+	}
+	num, _ := strconv.Atoi(string(m[1]))
+	return d.objects[num]
+}
+
+// dictValue returns what follows /key in a dictionary, up to the end of
+// the dictionary; the caller reads the value off its start.
+func dictValue(dict []byte, key string) []byte {
+	k := []byte("/" + key)
+	for i := 0; i < len(dict); {
+		j := bytes.Index(dict[i:], k)
+		if j < 0 {
+			return nil
+		}
+		end := i + j + len(k)
+		if end == len(dict) || isDelimiter(dict[end]) || isWhite(dict[end]) {
+			return bytes.TrimLeft(dict[end:], " \t\r\n\f\x00")
+		}
+		i = end
+	}
+	return nil
+}
+
+func intValue(dict []byte, key string) int {
+	v := dictValue(dict, key)
+	end := 0
+	for end < len(v) && v[end] >= '0' && v[end] <= '9' {
+		end++
+	}
+	n, _ := strconv.Atoi(string(v[:end]))
+	return n
+}
+
+// showText writes the strings shown by the text operators of a content
+// stream, decoding them through the ToUnicode map of the font selected by
+// Tf when fonts has one.
+func showText(c []byte, fonts map[string]*cmap, out *strings.Builder) {
+	var pending []string
+	var name string
+	var font *cmap
+	decode := func(s []byte) string {
+		if font != nil {
+			return font.decode(s)
+		}
+		return decodeString(s)
+	}
+	for i := 0; i < len(c); {
+		ch := c[i]
+		switch {
+		case ch == '(':
+			s, n := literalString(c[i:])
+			pending = append(pending, decode(s))
+			i += n
+		case ch == '<' && i+1 < len(c) && c[i+1] != '<':
+			s, n := hexString(c[i:])
+			pending = append(pending, decode(s))
+			i += n
+		case ch == '/':
+			j := i + 1
+			for j < len(c) && !isDelimiter(c[j]) && !isWhite(c[j]) {
+				j++
+			}
+			name = string(c[i+1 : j])
+			i = j
+		case ch == '%':
+			for i < len(c) && c[i] != '\n' && c[i] != '\r' {
+				i++
+			}
+		case isDelimiter(ch) || isWhite(ch):
+			i++
+		default:
+			j := i
+			for j < len(c) && !isDelimiter(c[j]) && !isWhite(c[j]) {
+				j++
+			}
+			tok := string(c[i:j])
+			i = j
+			if n, err := strconv.ParseFloat(tok, 64); err == nil {
+				// Inside TJ arrays, a large backwards kern is a space
+				if n < wordGap && len(pending) > 0 {
+					pending = append(pending, " ")
+				}
+				continue
+			}
+			switch tok {
+			case "Tf":
+				font = fonts[name]
+			case "Tj", "TJ":
+				out.WriteString(strings.Join(pending, ""))
+			case "'", "\"":
+				out.WriteByte('\n')
+				out.WriteString(strings.Join(pending, ""))
+			case "Td", "TD", "Tm":
+				out.WriteByte(' ')
+			case "T*", "ET":
+				out.WriteByte('\n')
+			}
+			pending = pending[:0]
+		}
+	}
+}
+
+func isWhite(ch byte) bool {
+	return ch == ' ' || ch == '\n' || ch == '\r' || ch == '\t' || ch == '\f' || ch == 0
+}
+
+func isDelimiter(ch byte) bool {
+	return strings.IndexByte("()<>[]{}/%", ch) >= 0
+}
+
+// literalString reads a (...) string starting at c[0], returning its bytes
+// and the length consumed.
+func literalString(c []byte) ([]byte, int) {
+	var s []byte
+	depth := 0
+	for i := 0; i < len(c); i++ {
+		ch := c[i]
+		switch ch {
+		case '(':
+			depth++
+			if depth == 1 {
+				continue
+			}
+		case ')':
+			depth--
+			if depth == 0 {
+				return s, i + 1
+			}
+		case '\\':
+			i++
+			if i >= len(c) {
+				return s, i
+			}
+			switch e := c[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b':
+				s = append(s, '\b')
+			case 'f':
+				s = append(s, '\f')
+			case '\r':
+				// line continuation
+				if i+1 < len(c) && c[i+1] == '\n' {
+					i++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					n := 0
+					for n < 3 && i < len(c) && c[i] >= '0' && c[i] <= '7' {
+						v = v*8 + int(c[i]-'0')
+						i++
+						n++
+					}
+					i--
+					s = append(s, byte(v))
+				} else {
+					s = append(s, e)
+				}
+			}
+			continue
+		}
+		s = append(s, ch)
+	}
+	return s, len(c)
+}
+
+// hexString reads a <...> string starting at c[0].
+func hexString(c []byte) ([]byte, int) {
+	var s []byte
+	hi := -1
+	for i := 1; i < len(c); i++ {
+		ch := c[i]
+		if ch == '>' {
+			if hi >= 0 {
+				s = append(s, byte(hi<<4))
+			}
+			return s, i + 1
+		}
+		v := hexValue(ch)
+		if v < 0 {
+			continue
+		}
+		if hi < 0 {
+			hi = v
+		} else {
+			s = append(s, byte(hi<<4|v))
+			hi = -1
+		}
+	}
+	return s, len(c)
+}
+
+func hexValue(ch byte) int {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return int(ch - '0')
+	case ch >= 'a' && ch <= 'f':
+		return int(ch-'a') + 10
+	case ch >= 'A' && ch <= 'F':
+		return int(ch-'A') + 10
+	}
+	return -1
+}
+
+// decodeString turns string bytes into text: UTF-16 when they start with a
+// byte order mark, Latin-1 otherwise.
+func decodeString(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+		return utf16BE(s[2:])
+	}
+	r := make([]rune, len(s))
+	for i, b := range s {
+		r[i] = rune(b)
+	}
+	return string(r)
+}
+
+// utf16BE decodes big-endian UTF-16, dropping an odd trailing byte.
+func utf16BE(s []byte) string {
+	u := make([]uint16, 0, len(s)/2)
+	for i := 0; i+1 < len(s); i += 2 {
+		u = append(u, uint16(s[i])<<8|uint16(s[i+1]))
+	}
+	return string(utf16.Decode(u))
+}
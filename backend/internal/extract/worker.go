@@ -0,0 +1,236 @@
+package extract
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/jackc/pgx/v5"
+)
+
+// Extraction results stored in blob_text.status.
+const (
+	StatusOK          = "ok"
+	StatusUnsupported = "unsupported"
+	StatusSkipped     = "skipped" // too large
+	StatusFailed      = "failed"
+)
+
+// sweepInterval is how often blobs that were never queued, e.g. because
+// they predate extraction or the server stopped first, are looked for.
+const sweepInterval = time.Hour
+
+// queue carries the hashes of newly stored blobs to the workers.
+var queue = make(chan string, 1024)
+
+// workers is how many documents are extracted at once, from
+// EXTRACT_WORKERS (default 2); 0 turns extraction off.
+func workers() int {
+	if n, err := strconv.Atoi(os.Getenv("EXTRACT_WORKERS")); err == nil && n >= 0 {
+		return n
+	}
+	return 2
+}
+
+// maxSize is the largest document that is extracted, from
+// EXTRACT_MAX_SIZE in bytes (default 50 MB).
+func maxSize() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("EXTRACT_MAX_SIZE"), 10, 64); err == nil && n > 0 {
+		return n
+	}
+	return 50 << 20
+}
+
+// Enqueue asks for a blob's text to be extracted once its upload has
+// committed. It never blocks; when the queue is full the blob is left for
+// the next sweep.
+func Enqueue(hash string) {
+	select {
+	case queue <- hash:
+	default:
+	}
+}
+
+// Start runs the extraction workers in the background, along with a sweep
+// for blobs without extracted text at startup and every sweepInterval.
+func Start(ctx context.Context) {
+	n := workers()
+	if n <= 0 {
+		log.Println("extract: text extraction disabled")
+		return
+	}
+	for i := 0; i < n; i++ {
+		go work(ctx)
+	}
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			if err := sweep(ctx); err != nil {
+				log.Printf("extract: sweep failed: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case hash := <-queue:
+			if err := process(ctx, hash); err != nil {
+				log.Printf("extract: %s: %v", hash, err)
+			}
+		}
+	}
+}
+
+// sweep queues every blob that has no extraction result yet, or was
+// unsupported and may since have gained a file of a supported type,
+// waiting for room in the queue rather than dropping any.
+func sweep(ctx context.Context) error {
+	last := ""
+	for {
+		rows, err := db.DB.Query(ctx, `
+			SELECT b.hash FROM blobs b
+			WHERE b.hash > $1 AND NOT EXISTS (SELECT 1 FROM blob_text t WHERE t.hash = b.hash AND t.status <> $2)
+			ORDER BY b.hash LIMIT 500`, last, StatusUnsupported)
+		if err != nil {
+			return err
+		}
+		var hashes []string
+		for rows.Next() {
+			var hash string
+			if err := rows.Scan(&hash); err != nil {
+				rows.Close()
+				return err
+			}
+			hashes = append(hashes, hash)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(hashes) == 0 {
+			return nil
+		}
+		for _, hash := range hashes {
+			select {
+			case queue <- hash:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		last = hashes[len(hashes)-1]
+	}
+}
+
+// process extracts and stores the text of one blob, unless that has been
+// done already. A blob found unsupported is looked at again, since a file
+// of a supported type or name may have been added with the same content.
+func process(ctx context.Context, hash string) error {
+	var status string
+	err := db.DB.QueryRow(ctx, "SELECT status FROM blob_text WHERE hash=$1", hash).Scan(&status)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if err == nil && status != StatusUnsupported {
+		return nil
+	}
+	retry := err == nil
+
+	// Any file with the content names its type; the first that can be
+	// extracted decides
+	rows, err := db.DB.Query(ctx, `
+		SELECT mime_type, filename FROM files WHERE hash=$1
+		UNION ALL
+		SELECT v.mime_type, f.filename FROM file_versions v JOIN files f ON f.id = v.file_id WHERE v.hash=$1`, hash)
+	if err != nil {
+		return err
+	}
+	var mimeType, filename string
+	found, supported := false, false
+	for rows.Next() && !supported {
+		if err := rows.Scan(&mimeType, &filename); err != nil {
+			rows.Close()
+			return err
+		}
+		found = true
+		supported = Supported(mimeType, filename)
+	}
+	rows.Close()
+	if !found {
+		return nil
+	}
+	if !supported {
+		if retry {
+			return nil
+		}
+		return record(ctx, hash, "", StatusUnsupported, "")
+	}
+
+	blob, err := blobs.Get(ctx, db.DB, hash)
+	if errors.Is(err, blobs.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Unreadable now; the next sweep tries again
+	if !blob.Available() {
+		return nil
+	}
+	if blob.Size > maxSize() {
+		return record(ctx, hash, "", StatusSkipped, "larger than EXTRACT_MAX_SIZE")
+	}
+
+	body, err := blob.Open(ctx)
+	if err != nil {
+		return err
+	}
+	text, err := safeExtract(body, blob.Size, mimeType, filename)
+	body.Close()
+	if err != nil {
+		return record(ctx, hash, "", StatusFailed, err.Error())
+	}
+	return record(ctx, hash, text, StatusOK, "")
+}
+
+// safeExtract is Extract turning a panic on a malformed document into an
+// error, so the blob is recorded as failed instead of taking the server
+// down and being retried on every start.
+func safeExtract(r io.Reader, size int64, mimeType, filename string) (text string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("extractor panicked: %v", p)
+		}
+	}()
+	return Extract(r, size, mimeType, filename)
+}
+
+func record(ctx context.Context, hash, text, status, reason string) error {
+	_, err := db.DB.Exec(ctx, `
+		INSERT INTO blob_text (hash, body, tsv, status, error, extracted_at)
+		VALUES ($1, $2, to_tsvector($3::regconfig, $2), $4, NULLIF($5, ''), CURRENT_TIMESTAMP)
+		ON CONFLICT (hash) DO UPDATE SET body = EXCLUDED.body, tsv = EXCLUDED.tsv, status = EXCLUDED.status,
+		    error = EXCLUDED.error, extracted_at = EXCLUDED.extracted_at`,
+		hash, text, Config, status, reason)
+	// The blob may have been deleted meanwhile
+	if err != nil && status == StatusOK {
+		return record(ctx, hash, "", StatusFailed, "indexing failed: "+err.Error())
+	}
+	return err
+}
@@ -0,0 +1,451 @@
+// Package gc reconciles blob storage with the database. Bodies nothing
+// refers to are moved to a quarantine area once they are older than a grace
+// period, and purged from quarantine later; blob rows whose body has gone
+// missing are flagged; blob rows without references and stale resumable
+// uploads are cleaned up.
+package gc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+)
+
+// quarantinePrefix is where unreferenced bodies wait before being purged.
+const quarantinePrefix = "quarantine/"
+
+// maxSamples caps how many individual entries a report lists per category.
+const maxSamples = 100
+
+// Object is a stored body mentioned in a report.
+type Object struct {
+	Ref     string    `json:"ref"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Finding counts one kind of problem and lists the first few cases.
+type Finding struct {
+	Count   int      `json:"count"`
+	Bytes   int64    `json:"bytes"`
+	Samples []Object `json:"samples"`
+}
+
+func (f *Finding) add(o Object) {
+	f.Count++
+	f.Bytes += o.Size
+	if len(f.Samples) < maxSamples {
+		f.Samples = append(f.Samples, o)
+	}
+}
+
+// Report describes what a collection run found and, unless it was a dry
+// run, did about it.
+type Report struct {
+	DryRun        bool      `json:"dry_run"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	Scanned       int       `json:"scanned"`
+	Unreferenced  Finding   `json:"unreferenced"`   // quarantined, or would be
+	InGrace       Finding   `json:"in_grace"`       // unreferenced but too young to touch
+	Purged        Finding   `json:"purged"`         // removed from quarantine
+	MissingBodies Finding   `json:"missing_bodies"` // rows whose body is gone
+	ZeroRefRows   Finding   `json:"zero_ref_rows"`  // blob rows no file points at
+	StaleUploads  Finding   `json:"stale_uploads"`  // abandoned resumable uploads
+	StagingFiles  Finding   `json:"staging_files"`  // leftover staging files
+	Errors        []string  `json:"errors,omitempty"`
+}
+
+func (r *Report) fail(format string, err error) {
+	log.Printf("gc: %s: %v", format, err)
+	if len(r.Errors) < maxSamples {
+		r.Errors = append(r.Errors, format+": "+err.Error())
+	}
+}
+
+// Config holds the collector's timings, read from the environment.
+type Config struct {
+	Interval            time.Duration // GC_INTERVAL, default 24h; 0 disables the schedule
+	GracePeriod         time.Duration // GC_GRACE_PERIOD, default 24h
+	QuarantineRetention time.Duration // GC_QUARANTINE_RETENTION, default 7 days
+	UploadSessionTTL    time.Duration // UPLOAD_SESSION_TTL, default 7 days
+}
+
+func ConfigFromEnv() Config {
+	return Config{
+		Interval:            envDuration("GC_INTERVAL", 24*time.Hour),
+		GracePeriod:         envDuration("GC_GRACE_PERIOD", 24*time.Hour),
+		QuarantineRetention: envDuration("GC_QUARANTINE_RETENTION", 7*24*time.Hour),
+		UploadSessionTTL:    envDuration("UPLOAD_SESSION_TTL", 7*24*time.Hour),
+	}
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	if v == "off" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("gc: invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// running keeps scheduled and manual runs from overlapping.
+var running sync.Mutex
+
+// ErrBusy is returned by Run when another collection is in progress.
+var ErrBusy = errors.New("garbage collection already running")
+
+// Start runs the collector on the configured interval in the background.
+func Start(ctx context.Context) {
+	cfg := ConfigFromEnv()
+	if cfg.Interval <= 0 {
+		log.Println("gc: scheduled collection disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := Run(ctx, false)
+				if err != nil {
+					log.Printf("gc: run failed: %v", err)
+					continue
+				}
+				log.Printf("gc: quarantined %d, purged %d, missing %d, %d errors",
+					report.Unreferenced.Count, report.Purged.Count, report.MissingBodies.Count, len(report.Errors))
+			}
+		}
+	}()
+}
+
+// Run performs one collection. With dryRun set nothing is changed and the
+// report shows what would have been done.
+func Run(ctx context.Context, dryRun bool) (*Report, error) {
+	if !running.TryLock() {
+		return nil, ErrBusy
+	}
+	defer running.Unlock()
+
+	cfg := ConfigFromEnv()
+	report := &Report{DryRun: dryRun, StartedAt: time.Now()}
+
+	if err := dropZeroRefRows(ctx, report, dryRun); err != nil {
+		return nil, err
+	}
+	referenced, err := referencedBodies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	present, err := sweepStores(ctx, cfg, report, referenced, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if err := flagMissing(ctx, report, referenced, present, dryRun); err != nil {
+		return nil, err
+	}
+	if err := cleanUploads(ctx, cfg, report, dryRun); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// dropZeroRefRows removes blob rows whose last file went away without the
+// blob being released, e.g. after a crash.
+func dropZeroRefRows(ctx context.Context, report *Report, dryRun bool) error {
+	rows, err := db.DB.Query(ctx, "SELECT hash, size FROM blobs WHERE ref_count <= 0")
+	if err != nil {
+		return err
+	}
+	var hashes []string
+	for rows.Next() {
+		var o Object
+		if err := rows.Scan(&o.Ref, &o.Size); err != nil {
+			rows.Close()
+			return err
+		}
+		report.ZeroRefRows.add(o)
+		hashes = append(hashes, o.Ref)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || dryRun {
+		return err
+	}
+
+	for _, hash := range hashes {
+		tx, err := db.DB.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		// The bodies are left for the sweep below to quarantine, like any
+		// other unreferenced body.
+		_, err = blobs.DropUnreferenced(ctx, tx, hash)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		tx.Rollback(ctx)
+		if err != nil {
+			report.fail("drop blob row "+hash, err)
+		}
+	}
+	return nil
+}
+
+// referencedBodies returns every storage reference the database points at.
+func referencedBodies(ctx context.Context) (map[string]bool, error) {
+	rows, err := db.DB.Query(ctx, `
+		SELECT storage_key FROM blobs WHERE NOT chunked
+		UNION SELECT storage_key FROM chunks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := map[string]bool{}
+	for rows.Next() {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			return nil, err
+		}
+		if ref, ok := canonicalRef(ref); ok {
+			refs[ref] = true
+		}
+	}
+	return refs, rows.Err()
+}
+
+// canonicalRef turns a stored reference, which may be a legacy value
+// without a backend prefix, into the "<backend>:<key>" the sweep builds
+// from listings. ok is false when its backend is not configured.
+func canonicalRef(ref string) (string, bool) {
+	store, key, err := storage.Resolve(ref)
+	if err != nil {
+		return "", false
+	}
+	return refFor(store, key), true
+}
+
+// refFor builds the canonical "<backend>:<key>" for a key in store.
+func refFor(store storage.BlobStore, key string) string {
+	for name, s := range storage.Backends() {
+		if s == store {
+			return name + ":" + key
+		}
+	}
+	return key
+}
+
+// sweepStores lists every backend, quarantining unreferenced bodies past
+// the grace period and purging expired quarantine entries. It returns the
+// set of references that exist.
+func sweepStores(ctx context.Context, cfg Config, report *Report, referenced map[string]bool, dryRun bool) (map[string]bool, error) {
+	present := map[string]bool{}
+	now := time.Now()
+
+	for name, store := range storage.Backends() {
+		var stale, expired []storage.BlobInfo
+		err := store.List(ctx, "", func(info storage.BlobInfo) error {
+			report.Scanned++
+			ref := name + ":" + info.Key
+			obj := Object{Ref: ref, Size: info.Size, ModTime: info.ModTime}
+
+			switch {
+			case strings.HasPrefix(info.Key, quarantinePrefix):
+				if now.Sub(info.ModTime) > cfg.QuarantineRetention {
+					report.Purged.add(obj)
+					expired = append(expired, info)
+				}
+			case referenced[ref]:
+				present[ref] = true
+			case info.Key == ".gitkeep":
+			case now.Sub(info.ModTime) < cfg.GracePeriod:
+				report.InGrace.add(obj)
+			default:
+				report.Unreferenced.add(obj)
+				stale = append(stale, info)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if dryRun {
+			continue
+		}
+
+		for _, info := range stale {
+			if err := quarantine(ctx, store, info.Key); err != nil {
+				report.fail("quarantine "+name+":"+info.Key, err)
+			}
+		}
+		for _, info := range expired {
+			if err := store.Delete(ctx, info.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				report.fail("purge "+name+":"+info.Key, err)
+			}
+		}
+	}
+	return present, nil
+}
+
+// quarantine moves a body under quarantinePrefix. Bodies are copied rather
+// than renamed so this works on every backend.
+func quarantine(ctx context.Context, store storage.BlobStore, key string) error {
+	rc, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = store.Put(ctx, quarantinePrefix+key, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
+
+// flagMissing marks blob and chunk rows whose body was not found in the
+// listing, and clears the mark on rows whose body is back.
+func flagMissing(ctx context.Context, report *Report, referenced, present map[string]bool, dryRun bool) error {
+	for _, table := range []string{"blobs", "chunks"} {
+		cond := ""
+		if table == "blobs" {
+			cond = " WHERE NOT chunked"
+		}
+		rows, err := db.DB.Query(ctx,
+			"SELECT hash, storage_key, size, missing_since IS NOT NULL FROM "+table+cond)
+		if err != nil {
+			return err
+		}
+		// Rows are matched on their canonical reference, as listed, and
+		// updated by hash so legacy storage keys are covered too
+		var missing, found []string
+		for rows.Next() {
+			var hash string
+			var o Object
+			var flagged bool
+			if err := rows.Scan(&hash, &o.Ref, &o.Size, &flagged); err != nil {
+				rows.Close()
+				return err
+			}
+			ref, ok := canonicalRef(o.Ref)
+			switch {
+			case !ok || !referenced[ref]:
+			case !present[ref]:
+				o.Ref = table + "/" + hash + " (" + ref + ")"
+				report.MissingBodies.add(o)
+				missing = append(missing, hash)
+			case flagged:
+				found = append(found, hash)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if dryRun {
+			continue
+		}
+
+		_, err = db.DB.Exec(ctx,
+			"UPDATE "+table+" SET missing_since = COALESCE(missing_since, CURRENT_TIMESTAMP) WHERE hash = ANY($1)", missing)
+		if err != nil {
+			return err
+		}
+		_, err = db.DB.Exec(ctx,
+			"UPDATE "+table+" SET missing_since = NULL WHERE hash = ANY($1)", found)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanUploads removes resumable upload sessions nobody has touched for
+// UploadSessionTTL and staging files that belong to no live session.
+func cleanUploads(ctx context.Context, cfg Config, report *Report, dryRun bool) error {
+	if cfg.UploadSessionTTL > 0 {
+		rows, err := db.DB.Query(ctx, `
+			SELECT id, upload_offset, updated_at FROM upload_sessions
+			WHERE updated_at < $1`, time.Now().Add(-cfg.UploadSessionTTL))
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for rows.Next() {
+			var o Object
+			if err := rows.Scan(&o.Ref, &o.Size, &o.ModTime); err != nil {
+				rows.Close()
+				return err
+			}
+			report.StaleUploads.add(o)
+			ids = append(ids, o.Ref)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if !dryRun && len(ids) > 0 {
+			if _, err := db.DB.Exec(ctx, "DELETE FROM upload_sessions WHERE id = ANY($1)", ids); err != nil {
+				return err
+			}
+		}
+	}
+
+	live := map[string]bool{}
+	rows, err := db.DB.Query(ctx, "SELECT id FROM upload_sessions")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		live["tus-"+id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(storage.StagingDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || live[e.Name()] {
+			continue
+		}
+		// In-flight uploads stage here too; only touch old files
+		if time.Since(info.ModTime()) < cfg.GracePeriod {
+			continue
+		}
+		report.StagingFiles.add(Object{Ref: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+		if !dryRun {
+			os.Remove(filepath.Join(storage.StagingDir, e.Name()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// access is what a user may do with a file. Each level includes the ones
+// below it.
+type access int
+
+const (
+	accessRead   access = iota + 1 // download and view
+	accessWrite                    // change metadata such as tags
+	accessManage                   // visibility, share links, grants, delete
+)
+
+// Roles a file can be shared with, from file_grants.role.
+const (
+	roleViewer  = "viewer"
+	roleEditor  = "editor"
+	roleCoOwner = "co-owner"
+	roleOwner   = "owner"
+)
+
+// Group membership roles, from group_members.role.
+const (
+	groupViewer = "viewer"
+	groupMember = "member"
+	groupAdmin  = "admin"
+)
+
+var roleAccess = map[string]access{
+	roleViewer:  accessRead,
+	roleEditor:  accessWrite,
+	roleCoOwner: accessManage,
+	roleOwner:   accessManage,
+}
+
+// groupFileRole is the file role a group's members have on the group's own
+// files. Members can also manage the files they uploaded.
+var groupFileRole = map[string]string{
+	groupViewer: roleViewer,
+	groupMember: roleEditor,
+	groupAdmin:  roleCoOwner,
+}
+
+// fileRecord is the part of a files row needed to authorize and serve it.
+type fileRecord struct {
+	ID         int
+	OwnerID    int
+	Filename   string
+	MimeType   string
+	Hash       string
+	Visibility string
+	GroupID    *int // set for files owned by a group
+	FolderID   *int
+	Role       string // the requesting user's best role on the file
+}
+
+var (
+	errFileNotFound   = errors.New("file not found")
+	errFolderNotFound = errors.New("folder not found")
+	errFileDenied     = errors.New("access to file denied")
+)
+
+// authorizeFile loads a file and checks that userID has at least the
+// wanted access to it: as its owner, through a grant to them or to one of
+// their groups, or as a member of the group that owns it. Every
+// authenticated endpoint that reads or changes a file goes through here.
+// Files in the trash are not found.
+func authorizeFile(c *gin.Context, fileID string, userID interface{}, want access) (*fileRecord, error) {
+	return loadFile(c, fileID, userID, want, false)
+}
+
+// authorizeTrashed is authorizeFile for files in the trash.
+func authorizeTrashed(c *gin.Context, fileID string, userID interface{}, want access) (*fileRecord, error) {
+	return loadFile(c, fileID, userID, want, true)
+}
+
+func loadFile(c *gin.Context, fileID string, userID interface{}, want access, trashed bool) (*fileRecord, error) {
+	var f fileRecord
+	var granted, membership *string
+	var groupGranted []string
+	err := db.DB.QueryRow(c, `
+		SELECT f.id, f.user_id, f.filename, f.mime_type, f.hash, f.visibility, f.group_id, f.folder_id,
+		       (SELECT role FROM file_grants WHERE file_id = f.id AND user_id = $2),
+		       (SELECT role FROM group_members WHERE group_id = f.group_id AND user_id = $2),
+		       ARRAY(SELECT gg.role FROM group_grants gg
+		             JOIN group_members m ON m.group_id = gg.group_id AND m.user_id = $2
+		             WHERE gg.file_id = f.id)
+		FROM files f
+		WHERE f.id=$1 AND (f.deleted_at IS NOT NULL) = $3`, fileID, userID, trashed,
+	).Scan(&f.ID, &f.OwnerID, &f.Filename, &f.MimeType, &f.Hash, &f.Visibility, &f.GroupID, &f.FolderID,
+		&granted, &membership, &groupGranted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the strongest of every role the user holds on the file
+	roles := groupGranted
+	if granted != nil {
+		roles = append(roles, *granted)
+	}
+	switch {
+	case f.GroupID == nil && f.OwnerID == userID:
+		roles = append(roles, roleOwner)
+	case membership != nil && *membership != groupViewer && f.OwnerID == userID:
+		roles = append(roles, roleOwner)
+	case membership != nil:
+		roles = append(roles, groupFileRole[*membership])
+	}
+	for _, role := range roles {
+		if roleAccess[role] > roleAccess[f.Role] {
+			f.Role = role
+		}
+	}
+
+	if f.Role == "" {
+		return nil, errFileDenied
+	}
+	if roleAccess[f.Role] < want {
+		return nil, errFileDenied
+	}
+	return &f, nil
+}
+
+// accessibleFiles is an SQL condition on files f matching the files the
+// user in placeholder n can read, leaving out the trash.
+func accessibleFiles(n string) string {
+	return `f.deleted_at IS NULL AND (
+		(f.user_id = ` + n + ` AND f.group_id IS NULL)
+		OR EXISTS (SELECT 1 FROM file_grants g WHERE g.file_id = f.id AND g.user_id = ` + n + `)
+		OR EXISTS (SELECT 1 FROM group_members m WHERE m.group_id = f.group_id AND m.user_id = ` + n + `)
+		OR EXISTS (SELECT 1 FROM group_grants gg JOIN group_members m ON m.group_id = gg.group_id
+		           WHERE gg.file_id = f.id AND m.user_id = ` + n + `)
+	)`
+}
+
+// abortFileError answers with the status matching an authorizeFile or
+// authorizeFolder error.
+func abortFileError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errFileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errors.Is(err, errFolderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+	case errors.Is(err, errFileDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this file"})
+	default:
+		log.Printf("Failed to load file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load file"})
+	}
+}
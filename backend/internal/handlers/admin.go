@@ -6,30 +6,37 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
 	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
 )
 
 func AdminListAllFiles(c *gin.Context) {
-    rows, err := db.DB.Query(c, `
-        SELECT f.id, f.filename, f.mime_type, f.size, f.upload_date, f.visibility, f.download_count, u.username
-        FROM files f
-        LEFT JOIN users u ON f.user_id = u.id
-    `)
+    p, ok := parsePage(c, fileSorts(), "date")
+    if !ok {
+        return
+    }
+
+    query := newListQuery("files f LEFT JOIN users u ON f.user_id = u.id", "")
+    rows, total, err := query.run(c,
+        "f.id, f.filename, f.mime_type, f.size, f.upload_date, f.visibility, f.download_count, u.username", p)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "DB query failed"})
         return
     }
     defer rows.Close()
 
-    var results []map[string]interface{}
+    results := []map[string]interface{}{}
     for rows.Next() {
+        if p.done() {
+            break
+        }
         var id, downloadCount int
         var filename, mime, visibility string
         var size int64
         var uploadDate time.Time
         var username *string
 
-        if err := rows.Scan(&id, &filename, &mime, &size, &uploadDate, &visibility, &downloadCount, &username); err != nil {
+        if err := p.scan(rows, &id, &filename, &mime, &size, &uploadDate, &visibility, &downloadCount, &username); err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Scan failed"})
             return
         }
@@ -51,7 +58,7 @@ func AdminListAllFiles(c *gin.Context) {
         })
     }
 
-    c.JSON(http.StatusOK, gin.H{"files": results})
+    c.JSON(http.StatusOK, p.response(results, total))
 }
 
 
@@ -61,12 +68,34 @@ func AdminStats(c *gin.Context) {
 	var totalUsers int
 
 	db.DB.QueryRow(c, "SELECT COUNT(*) FROM files").Scan(&totalFiles)
-	db.DB.QueryRow(c, "SELECT COALESCE(SUM(size),0) FROM files").Scan(&totalStorage)
+	// Every reference to stored content: files, their versions and the
+	// trash, which all hold on to their blobs
+	db.DB.QueryRow(c, `SELECT COALESCE((SELECT SUM(size*ref_count) FROM files),0)
+		+ COALESCE((SELECT SUM(size) FROM file_versions),0)`).Scan(&totalStorage)
+	usage, err := blobs.MeasureUsage(c, db.DB, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to measure storage"})
+		return
+	}
 	db.DB.QueryRow(c, "SELECT COUNT(*) FROM users").Scan(&totalUsers)
 
+	// Cross-user deduplication: logical bytes vs distinct content
+	dedupSavings := totalStorage - usage.Content
+	var dedupPercent float64
+	if totalStorage > 0 {
+		dedupPercent = float64(dedupSavings) / float64(totalStorage) * 100
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"total_files":   totalFiles,
-		"total_storage": totalStorage,
-		"total_users":   totalUsers,
+		"total_files":         totalFiles,
+		"total_storage":       totalStorage,
+		"unique_storage":      usage.Content,
+		"physical_storage":    usage.Stored,
+		"dedup_savings":       dedupSavings,
+		"dedup_percent":       dedupPercent,
+		"compression_savings": usage.CompressionSavings,
+		"compression_percent": usage.CompressionPercent(),
+		"encryption_overhead": usage.EncryptionOverhead,
+		"total_users":         totalUsers,
 	})
 }
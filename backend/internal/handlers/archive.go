@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+)
+
+// manifestName is the archive entry listing every file's SHA-256 in the
+// format `sha256sum -c` understands.
+const manifestName = "SHA256SUMS"
+
+type archiveEntry struct {
+	id         int
+	filename   string
+	hash       string
+	size       int64
+	uploadDate time.Time
+	available  bool
+}
+
+// DownloadArchive streams the selected files as a ZIP archive. Files are
+// picked with ?ids=1,2,3 (or repeated ids=), which may include files shared
+// with the user, or, without ids, with the same scope and filters as
+// SearchFiles. The archive is written straight to the response;
+// ZIP64 records are used automatically once entries or the archive pass
+// 4 GiB.
+func DownloadArchive(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+
+	query := `
+		SELECT id, filename, hash, size, upload_date,
+		       COALESCE((SELECT integrity NOT IN ('corrupt', 'missing') FROM blobs WHERE blobs.hash = f.hash), true)
+		FROM files f WHERE `
+	args := []interface{}{userID}
+
+	var ids []int
+	for _, raw := range c.QueryArray("ids") {
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file id " + strconv.Quote(s)})
+				return
+			}
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 {
+		// Listed files may include ones shared with the user
+		query += accessibleFiles("$1") + " AND id = ANY($2)"
+		args = append(args, ids)
+	} else {
+		scope, scopeArgs, ok := fileScope(c, userID)
+		if !ok {
+			return
+		}
+		q := newListQuery("files f", scope, scopeArgs...)
+		if !searchFilters(c, q) {
+			return
+		}
+		query += strings.Join(q.where, " AND ")
+		args = q.args
+	}
+	query += " ORDER BY upload_date, id"
+
+	rows, err := db.DB.Query(c, query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+	var entries []archiveEntry
+	for rows.Next() {
+		var e archiveEntry
+		if err := rows.Scan(&e.id, &e.filename, &e.hash, &e.size, &e.uploadDate, &e.available); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan file data"})
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+
+	// Everything is checked before the first byte is sent; after that the
+	// status can no longer change.
+	if len(ids) > 0 {
+		if missing := missingIDs(ids, entries); len(missing) > 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Some files were not found", "missing": missing})
+			return
+		}
+	}
+	if len(entries) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No files matched"})
+		return
+	}
+	var unavailable []int
+	for _, e := range entries {
+		if !e.available {
+			unavailable = append(unavailable, e.id)
+		}
+	}
+	if len(unavailable) > 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "Some files failed an integrity check and are unavailable", "unavailable": unavailable})
+		return
+	}
+
+	name := fmt.Sprintf("files-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Status(http.StatusOK)
+
+	if err := writeArchive(c, c.Writer, entries); err != nil {
+		log.Printf("Archive for user %v failed: %v", userID, err)
+		abortConnection(c)
+		return
+	}
+
+	downloaded := make([]int, len(entries))
+	for i, e := range entries {
+		downloaded[i] = e.id
+	}
+	if _, err := db.DB.Exec(c, "UPDATE files SET owner_download_count = owner_download_count + 1 WHERE id = ANY($1)", downloaded); err != nil {
+		log.Printf("Failed to update owner download counts: %v", err)
+	}
+}
+
+// abortConnection cuts the connection under a response already under way,
+// so the client sees a broken download rather than a short but
+// valid-looking one. A panic would not do: Recovery catches it and the
+// server then ends the chunked body cleanly.
+func abortConnection(c *gin.Context) {
+	c.Abort()
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		log.Printf("Failed to abort response: %v", err)
+		return
+	}
+	conn.Close()
+}
+
+func writeArchive(c *gin.Context, w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	names := uniqueNames{strings.ToLower(manifestName): true}
+	var manifest strings.Builder
+
+	for _, e := range entries {
+		blob, err := blobs.Get(c, db.DB, e.hash)
+		if err != nil {
+			return fmt.Errorf("file %d: %w", e.id, err)
+		}
+		body, err := blob.Open(c)
+		if err != nil {
+			return fmt.Errorf("file %d: %w", e.id, err)
+		}
+
+		name := names.claim(e.filename)
+		// Stored rather than deflated: most uploads are already compressed
+		// and this keeps the archive as fast as the disk or network
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:               name,
+			Method:             zip.Store,
+			Modified:           e.uploadDate,
+			UncompressedSize64: uint64(e.size),
+		})
+		if err == nil {
+			_, err = io.Copy(fw, body)
+		}
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("file %d: %w", e.id, err)
+		}
+		fmt.Fprintf(&manifest, "%s  %s\n", e.hash, name)
+	}
+
+	fw, err := zw.Create(manifestName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(fw, manifest.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// uniqueNames hands out archive entry names, renaming repeats to
+// "name (1).ext", "name (2).ext" and so on. Names are compared without
+// case so the archive extracts cleanly on case-insensitive file systems.
+type uniqueNames map[string]bool
+
+func (u uniqueNames) claim(filename string) string {
+	name := strings.TrimLeft(path.Clean("/"+strings.ReplaceAll(filename, "\\", "/")), "/")
+	name = path.Base(name)
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	candidate := name
+	for n := 1; u[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s (%d)%s", stem, n, ext)
+	}
+	u[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// missingIDs returns the requested ids with no matching entry.
+func missingIDs(ids []int, entries []archiveEntry) []int {
+	found := map[int]bool{}
+	for _, e := range entries {
+		found[e.id] = true
+	}
+	missing := []int{}
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
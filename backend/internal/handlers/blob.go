@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// serveBlob streams the content with the given hash to the client. With
+// attachment set the browser is told to download it as filename, otherwise
+// to display it inline. Range, If-Range, If-None-Match and
+// If-Modified-Since are honoured for every storage backend; the content
+// hash is the strong ETag.
+func serveBlob(c *gin.Context, hash, filename, mimeType string, attachment bool) {
+	blob, err := blobs.Get(c, db.DB, hash)
+	if err != nil {
+		log.Printf("Blob %s unavailable: %v", hash, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "File content not found"})
+		return
+	}
+	if !blob.Available() {
+		c.JSON(http.StatusGone, gin.H{"error": "File failed an integrity check and is unavailable"})
+		return
+	}
+
+	rs, err := blob.NewReader(c)
+	if err != nil {
+		log.Printf("Failed to open blob %s: %v", hash, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer rs.Close()
+
+	disposition := "inline"
+	if attachment {
+		disposition = "attachment"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("%s; filename*=UTF-8''%s", disposition, url.PathEscape(filename)))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	c.Header("Content-Type", mimeType)
+	c.Header("ETag", blobETag(hash))
+	c.Header("Cache-Control", "private, no-cache")
+
+	http.ServeContent(c.Writer, c.Request, "", blob.CreatedAt.UTC().Truncate(time.Second), rs)
+}
+
+func blobETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// countsAsDownload reports whether a request for the content with the given
+// hash should be counted as a download: a GET that will transfer the file
+// from its start, not a HEAD, a cache revalidation or a seek into the
+// middle of a video.
+func countsAsDownload(c *gin.Context, hash string) bool {
+	if !transfersContent(c, hash) {
+		return false
+	}
+	rng := c.GetHeader("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// transfersContent reports whether a request will be answered with some of
+// the content: a GET that is not a cache revalidation of it.
+func transfersContent(c *gin.Context, hash string) bool {
+	if c.Request.Method != http.MethodGet {
+		return false
+	}
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == blobETag(hash) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// errQuotaExceeded is returned by addFile when the owner cannot afford the file.
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// uploadTarget is who a new file belongs to and whose quota pays for it:
+// the uploading user, or a group they upload into. VersionOf is set when
+// the upload is a new version of that file. Tags are added to the file.
+type uploadTarget struct {
+	UserID    interface{}
+	GroupID   *int
+	FolderID  *int
+	VersionOf *fileRecord
+	Tags      []string
+}
+
+// quota returns the space the target has left.
+func (t uploadTarget) quota(ctx context.Context) (int64, error) {
+	var quota int64
+	var err error
+	if t.GroupID != nil {
+		err = db.DB.QueryRow(ctx, "SELECT storage_quota FROM groups WHERE id=$1", *t.GroupID).Scan(&quota)
+	} else {
+		err = db.DB.QueryRow(ctx, "SELECT storage_quota FROM users WHERE id=$1", t.UserID).Scan(&quota)
+	}
+	return quota, err
+}
+
+// addFile inserts a files row for the target pointing at the blob with the
+// staged content's hash and charges its size to the target's quota. The
+// content is only written to storage when no other file in the system
+// already holds it; shared reports whether an existing blob was reused.
+func addFile(ctx context.Context, target uploadTarget, filename, mimeType string, staged *storage.TempBlob) (id int, shared bool, err error) {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	charge := "UPDATE users SET storage_quota = storage_quota - $1 WHERE id=$2 AND storage_quota >= $1"
+	var payer interface{} = target.UserID
+	if target.GroupID != nil {
+		charge = "UPDATE groups SET storage_quota = storage_quota - $1 WHERE id=$2 AND storage_quota >= $1"
+		payer = *target.GroupID
+	}
+	tag, err := tx.Exec(ctx, charge, staged.Size, payer)
+	if err != nil {
+		return 0, false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, false, errQuotaExceeded
+	}
+
+	if shared, err = blobs.Acquire(ctx, tx, staged, mimeType); err != nil {
+		return 0, false, err
+	}
+
+	tags := target.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO files (user_id, group_id, folder_id, filename, mime_type, size, hash, tags)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		target.UserID, target.GroupID, target.FolderID, filename, mimeType, staged.Size, staged.Hash, tags,
+	).Scan(&id)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return id, shared, tx.Commit(ctx)
+}
+
+// refundQuota gives a deleted file's size back to whoever was charged for it.
+func refundQuota(ctx context.Context, tx pgx.Tx, f *fileRecord, size int64) error {
+	var err error
+	if f.GroupID != nil {
+		_, err = tx.Exec(ctx, "UPDATE groups SET storage_quota = storage_quota + $1 WHERE id=$2", size, *f.GroupID)
+	} else {
+		_, err = tx.Exec(ctx, "UPDATE users SET storage_quota = storage_quota + $1 WHERE id=$2", size, f.OwnerID)
+	}
+	return err
+}
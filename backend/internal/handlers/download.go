@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+)
+
+// DownloadFile sends a file the user has access to as an attachment,
+// whatever its visibility.
+func DownloadFile(c *gin.Context) {
+	serveOwnFile(c, true)
+}
+
+// ViewFile sends a file the user has access to inline, for previews.
+func ViewFile(c *gin.Context) {
+	serveOwnFile(c, false)
+}
+
+func serveOwnFile(c *gin.Context, attachment bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessRead)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	// Tracked apart from download_count, which counts public downloads.
+	// Downloads by users the file is shared with count here too.
+	if attachment && countsAsDownload(c, f.Hash) {
+		_, err = db.DB.Exec(c, "UPDATE files SET owner_download_count = owner_download_count + 1 WHERE id=$1", f.ID)
+		if err != nil {
+			log.Printf("Failed to update owner download count for file %d: %v", f.ID, err)
+		}
+	}
+	serveBlob(c, f.Hash, f.Filename, f.MimeType, attachment)
+}
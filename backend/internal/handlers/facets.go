@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+)
+
+const (
+	maxTagBuckets   = 20
+	maxMonthBuckets = 24
+)
+
+// FacetBucket is one value of a facet and how many matches have it. Filter
+// holds the search parameters that narrow the results to the bucket; a
+// query there is added alongside any query already given.
+type FacetBucket struct {
+	Value  string            `json:"value"`
+	Count  int               `json:"count"`
+	Filter map[string]string `json:"filter"`
+}
+
+// SearchPage is a page of search results with facet counts over every
+// match, left out with ?facets=false.
+type SearchPage struct {
+	Page
+	Facets map[string][]FacetBucket `json:"facets,omitempty"`
+}
+
+// mimeFamilies group MIME types for the type facet, matched in order by
+// the same substring test as ?mime= and type: in ?query=.
+var mimeFamilies = []struct {
+	name     string
+	patterns []string
+}{
+	{"pdf", []string{"application/pdf"}},
+	{"image", []string{"image/"}},
+	{"video", []string{"video/"}},
+	{"audio", []string{"audio/"}},
+	{"text", []string{"text/"}},
+	{"document", []string{"msword", "officedocument", "opendocument"}},
+	{"archive", []string{"zip", "x-tar", "gzip", "x-7z", "x-rar"}},
+}
+
+// sizeBuckets are the size facet's ranges, up to but not including max;
+// zero means no limit.
+var sizeBuckets = []struct {
+	name     string
+	min, max int64
+}{
+	{"<1MB", 0, 1 << 20},
+	{"1MB-10MB", 1 << 20, 10 << 20},
+	{"10MB-100MB", 10 << 20, 100 << 20},
+	{"100MB-1GB", 100 << 20, 1 << 30},
+	{">=1GB", 1 << 30, 0},
+}
+
+// searchFacets counts the files matching query's conditions by MIME type
+// family, tag, size, upload month and visibility. Every facet is present,
+// with buckets ordered by count except size, which keeps its order, and
+// month, newest first.
+func searchFacets(ctx context.Context, q *listQuery) (map[string][]FacetBucket, error) {
+	var family, bucket strings.Builder
+	family.WriteString("CASE")
+	for _, f := range mimeFamilies {
+		for _, p := range f.patterns {
+			fmt.Fprintf(&family, " WHEN COALESCE(mime_type, '') ILIKE '%%%s%%' THEN '%s'", p, f.name)
+		}
+	}
+	family.WriteString(" ELSE 'other' END")
+	bucket.WriteString("CASE")
+	for _, b := range sizeBuckets {
+		if b.max > 0 {
+			fmt.Fprintf(&bucket, " WHEN size < %d THEN '%s'", b.max, b.name)
+		} else {
+			fmt.Fprintf(&bucket, " ELSE '%s'", b.name)
+		}
+	}
+	bucket.WriteString(" END")
+
+	rows, err := db.DB.Query(ctx, `
+		WITH matched AS (SELECT mime_type, size, upload_date, visibility, tags FROM `+q.from+whereSQL(q.where)+`)
+		SELECT 'type', `+family.String()+`, count(*) FROM matched GROUP BY 2
+		UNION ALL
+		SELECT 'size', `+bucket.String()+`, count(*) FROM matched GROUP BY 2
+		UNION ALL
+		SELECT 'month', to_char(upload_date, 'YYYY-MM'), count(*) FROM matched WHERE upload_date IS NOT NULL GROUP BY 2
+		UNION ALL
+		SELECT 'visibility', COALESCE(visibility, 'private'), count(*) FROM matched GROUP BY 2
+		UNION ALL
+		SELECT 'tag', t, count(*) FROM matched, unnest(tags) t GROUP BY 2`,
+		q.args[:q.filterArgs]...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	facets := map[string][]FacetBucket{"type": {}, "tag": {}, "size": {}, "month": {}, "visibility": {}}
+	for rows.Next() {
+		var facet, value string
+		var count int
+		if err := rows.Scan(&facet, &value, &count); err != nil {
+			return nil, err
+		}
+		facets[facet] = append(facets[facet], FacetBucket{Value: value, Count: count, Filter: facetFilter(facet, value)})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byCount := func(buckets []FacetBucket) {
+		sort.Slice(buckets, func(i, j int) bool {
+			if buckets[i].Count != buckets[j].Count {
+				return buckets[i].Count > buckets[j].Count
+			}
+			return buckets[i].Value < buckets[j].Value
+		})
+	}
+	byCount(facets["type"])
+	byCount(facets["visibility"])
+	byCount(facets["tag"])
+	if len(facets["tag"]) > maxTagBuckets {
+		facets["tag"] = facets["tag"][:maxTagBuckets]
+	}
+	sort.Slice(facets["month"], func(i, j int) bool { return facets["month"][i].Value > facets["month"][j].Value })
+	if len(facets["month"]) > maxMonthBuckets {
+		facets["month"] = facets["month"][:maxMonthBuckets]
+	}
+	sizes := make([]FacetBucket, 0, len(sizeBuckets))
+	for _, b := range sizeBuckets {
+		for _, found := range facets["size"] {
+			if found.Value == b.name {
+				sizes = append(sizes, found)
+			}
+		}
+	}
+	facets["size"] = sizes
+	return facets, nil
+}
+
+// facetFilter returns the search parameters that select a facet bucket.
+func facetFilter(facet, value string) map[string]string {
+	switch facet {
+	case "tag":
+		return map[string]string{"tags": value}
+	case "visibility":
+		return map[string]string{"visibility": value}
+	case "month":
+		start, err := time.Parse("2006-01", value)
+		if err != nil {
+			return nil
+		}
+		return map[string]string{
+			"startDate": start.Format("2006-01-02"),
+			"endDate":   start.AddDate(0, 1, -1).Format("2006-01-02"),
+		}
+	case "size":
+		for _, b := range sizeBuckets {
+			if b.name != value {
+				continue
+			}
+			filter := map[string]string{}
+			if b.min > 0 {
+				filter["minSize"] = strconv.FormatInt(b.min, 10)
+			}
+			if b.max > 0 {
+				filter["maxSize"] = strconv.FormatInt(b.max-1, 10)
+			}
+			return filter
+		}
+	case "type":
+		// A single pattern is a plain ?mime=; the rest need the query
+		// language, and other excludes every family
+		var terms []string
+		for _, f := range mimeFamilies {
+			if f.name == value && len(f.patterns) == 1 {
+				return map[string]string{"mime": f.patterns[0]}
+			}
+			for _, p := range f.patterns {
+				if f.name == value {
+					terms = append(terms, "type:"+p)
+				} else if value == "other" {
+					terms = append(terms, "-type:"+p)
+				}
+			}
+		}
+		if value == "other" {
+			return map[string]string{"query": strings.Join(terms, " ")}
+		}
+		if len(terms) > 0 {
+			return map[string]string{"query": "(" + strings.Join(terms, " OR ") + ")"}
+		}
+	}
+	return nil
+}
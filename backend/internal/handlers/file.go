@@ -1,17 +1,26 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"io"
+	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
 	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
-	"github.com/Deeks779/balkanid-file-vault/backend/internal/utils"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/extract"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 )
 
-// Uploading file function
+// Uploading file function. The multipart body is read part by part; each
+// file is hashed while it is spooled to a staging blob, so it is read only
+// once and never buffered in memory.
 func UploadFile(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -19,113 +28,225 @@ func UploadFile(c *gin.Context) {
 		return
 	}
 
-	form, err := c.MultipartForm()
+	target, ok := resolveUploadTarget(c, userID, c.Query)
+	if !ok {
+		return
+	}
+
+	reader, err := c.Request.MultipartReader()
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload"})
 		return
 	}
 
-	files := form.File["files"]
-	if len(files) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No files uploaded"})
+	quota, err := target.quota(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve user quota"})
 		return
 	}
 
-	var savedFiles []map[string]interface{}
+	savedFiles := []gin.H{}
 
-	for _, file := range files {
-		// Save temporarily
-		savePath := filepath.Join("uploads", file.Filename)
-		if err := c.SaveUploadedFile(file, savePath); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
-			return
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
 		}
-
-		// Compute hash
-		hash, err := utils.FileHash(savePath)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash file"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload", "files": savedFiles})
 			return
 		}
-
-		// Check deduplication
-		var existingID int
-		var refCount int
-		var size int64
-		query := `SELECT id, ref_count, size FROM files WHERE hash=$1 AND user_id=$2`
-		err = db.DB.QueryRow(c, query, hash, userID).Scan(&existingID, &refCount, &size)
-
-		if err == nil {
-			// Duplicate found → increment ref_count
-			_, err = db.DB.Exec(c, "UPDATE files SET ref_count=$1 WHERE id=$2", refCount+1, existingID)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "DB update failed"})
-				return
+		// A tags field applies to the files that follow it
+		if part.FormName() == "tags" && part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, 4<<10))
+			part.Close()
+			var tags []string
+			if err == nil {
+				tags, err = splitTags(append(target.Tags, string(value))...)
+			}
+			if err == nil && len(tags) > maxTagsPerFile {
+				err = errTooManyTags
 			}
-			_, err = db.DB.Exec(c, "UPDATE users SET storage_quota = storage_quota + $1 WHERE id=$2", size, userID)
 			if err != nil {
-				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user quota"})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "files": savedFiles})
 				return
 			}
-			// Remove duplicate physical file
-			os.Remove(savePath)
-
-			savedFiles = append(savedFiles, map[string]interface{}{
-				"filename": file.Filename,
-				"status":   "duplicate (reference added)",
-			})
+			target.Tags = tags
+			continue
+		}
+		if part.FormName() != "files" || part.FileName() == "" {
+			part.Close()
 			continue
 		}
 
-		// Store new file metadata
-		query = `INSERT INTO files (user_id, filename, mime_type, size, hash, path) 
-           VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
-		var id int
-		err = db.DB.QueryRow(c, query,
-			userID,
-			file.Filename,
-			file.Header.Get("Content-Type"),
-			file.Size,
-			hash,
-			savePath).Scan(&id)
+		// Stop reading as soon as the part outgrows what the user may store
+		limit := quota
+		if max := maxUploadSize(); max > 0 && max < limit {
+			limit = max
+		}
+		blob, err := storage.NewTempBlob(part, limit)
+		part.Close()
+		if errors.Is(err, storage.ErrTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": "Upload size exceeds available storage quota",
+				"quota": quota,
+				"files": savedFiles,
+			})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file", "files": savedFiles})
+			return
+		}
 
+		saved, charged, err := ingestFile(c, target, part.FileName(), part.Header.Get("Content-Type"), blob)
+		blob.Close()
+		if errors.Is(err, errQuotaExceeded) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Upload size exceeds available storage quota", "files": savedFiles})
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "DB insert failed"})
+			log.Printf("Failed to store upload %q: %v", part.FileName(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file", "files": savedFiles})
 			return
 		}
+		if charged {
+			quota -= blob.Size
+		}
+		savedFiles = append(savedFiles, saved)
+	}
 
-		savedFiles = append(savedFiles, map[string]interface{}{
-			"id":       id,
-			"filename": file.Filename,
-			"status":   "uploaded",
-		})
+	if len(savedFiles) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files uploaded"})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"files": savedFiles})
 }
 
+// ingestFile records a staged upload for the target. Content for a file
+// that already exists, named by the target or by having the same name in
+// the same folder, becomes its new version; anything else becomes a new
+// files row charged to the quota, even when the user already holds the
+// same content, so each copy can be deleted on its own. Only the blob is
+// shared. charged reports whether the upload was charged to the quota.
+func ingestFile(ctx context.Context, target uploadTarget, filename, mimeType string, blob *storage.TempBlob) (saved gin.H, charged bool, err error) {
+	existing := target.VersionOf
+	if existing == nil {
+		if existing, err = sameNamedFile(ctx, target, filename); err != nil {
+			return nil, false, err
+		}
+	}
+	if existing != nil {
+		version, err := addVersion(ctx, existing, blob.Hash, blob.Size, mimeType, func(tx pgx.Tx) error {
+			_, err := blobs.Acquire(ctx, tx, blob, mimeType)
+			return err
+		})
+		charged := true
+		saved := gin.H{"id": existing.ID, "filename": filename, "version": version, "status": "new version"}
+		if errors.Is(err, errVersionUnchanged) {
+			charged = false
+			saved["status"] = "unchanged"
+		} else if err != nil {
+			return nil, false, err
+		} else {
+			extract.Enqueue(blob.Hash)
+		}
+		return tagExisting(ctx, existing.ID, target.Tags, saved), charged, nil
+	}
+
+	// Store new file metadata, sharing the blob with any file that has
+	// the same content
+	id, shared, err := addFile(ctx, target, filename, mimeType, blob)
+	if err != nil {
+		return nil, false, err
+	}
+	// Index the content in the background now that it is committed
+	extract.Enqueue(blob.Hash)
+
+	status := "uploaded"
+	if shared {
+		status = "uploaded (content deduplicated)"
+	}
+	return gin.H{
+		"id":       id,
+		"filename": filename,
+		"status":   status,
+	}, true, nil
+}
+
+// tagExisting adds an upload's tags to the existing file it was merged
+// into. The upload itself has succeeded, so a failure is only reported.
+func tagExisting(ctx context.Context, fileID int, tags []string, saved gin.H) gin.H {
+	if len(tags) == 0 {
+		return saved
+	}
+	if _, err := addTags(ctx, fileID, tags); err != nil {
+		saved["tags_error"] = err.Error()
+	}
+	return saved
+}
+
+// sameNamedFile finds the newest file called filename in the target's
+// folder, or returns nil.
+func sameNamedFile(ctx context.Context, target uploadTarget, filename string) (*fileRecord, error) {
+	s := space{UserID: target.UserID, GroupID: target.GroupID}
+	cond, arg := s.filter("", 1)
+	f := fileRecord{Filename: filename}
+	err := db.DB.QueryRow(ctx, `
+		SELECT id, user_id, group_id FROM files
+		WHERE `+cond+` AND folder_id IS NOT DISTINCT FROM $2 AND filename=$3 AND deleted_at IS NULL
+		ORDER BY upload_date DESC LIMIT 1`, arg, target.FolderID, filename,
+	).Scan(&f.ID, &f.OwnerID, &f.GroupID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// maxUploadSize is the per-file limit from MAX_UPLOAD_SIZE in bytes; zero
+// means only the user's quota applies.
+func maxUploadSize() int64 {
+	n, _ := strconv.ParseInt(os.Getenv("MAX_UPLOAD_SIZE"), 10, 64)
+	return n
+}
+
 // File listing endpoint function
 type FileInfo struct {
-	ID            int       `json:"id"`
-	Filename      string    `json:"filename"`
-	MimeType      string    `json:"mime_type"`
-	Size          int64     `json:"size"`
-	UploadDate    time.Time `json:"upload_date"`
-	RefCount      int       `json:"ref_count"`
-	Visibility    string    `json:"visibility"`
-	DownloadCount int       `json:"download_count"`
+	ID                 int       `json:"id"`
+	Filename           string    `json:"filename"`
+	MimeType           string    `json:"mime_type"`
+	Size               int64     `json:"size"`
+	UploadDate         time.Time `json:"upload_date"`
+	RefCount           int       `json:"ref_count"`
+	Visibility         string    `json:"visibility"`
+	DownloadCount      int       `json:"download_count"`
+	OwnerDownloadCount int       `json:"owner_download_count"`
+	FolderID           *int      `json:"folder_id"`
+	Tags               []string  `json:"tags"`
+	Available          bool      `json:"available"`
 }
 
+// ListFiles lists the user's own files, or with ?group_id= a group's files,
+// a page at a time, newest first unless ?sort= says otherwise.
 func ListFiles(c *gin.Context) {
 	userID, _ := c.Get("user_id")
+	scope, args, ok := fileScope(c, userID)
+	if !ok {
+		return
+	}
+	p, ok := parsePage(c, fileSorts(), "date")
+	if !ok {
+		return
+	}
 
-	query := `
-		SELECT id, filename, mime_type, size, upload_date, ref_count, visibility, download_count
-		FROM files
-		WHERE user_id=$1
-		ORDER BY upload_date DESC`
-
-	rows, err := db.DB.Query(c, query, userID)
+	query := newListQuery("files f LEFT JOIN blobs b ON b.hash = f.hash", scope, args...)
+	rows, total, err := query.run(c, `
+		f.id, f.filename, f.mime_type, f.size, f.upload_date, f.ref_count, f.visibility, f.download_count, f.owner_download_count, f.folder_id,
+		COALESCE(f.tags, '{}'), COALESCE(b.integrity NOT IN ('corrupt', 'missing'), true)`, p)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
 		return
@@ -134,10 +255,13 @@ func ListFiles(c *gin.Context) {
 
 	files := []FileInfo{}
 	for rows.Next() {
+		if p.done() {
+			break
+		}
 		var file FileInfo
-		if err := rows.Scan(
+		if err := p.scan(rows,
 			&file.ID, &file.Filename, &file.MimeType, &file.Size,
-			&file.UploadDate, &file.RefCount, &file.Visibility, &file.DownloadCount,
+			&file.UploadDate, &file.RefCount, &file.Visibility, &file.DownloadCount, &file.OwnerDownloadCount, &file.FolderID, &file.Tags, &file.Available,
 		); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan file data"})
 			return
@@ -145,7 +269,7 @@ func ListFiles(c *gin.Context) {
 		files = append(files, file)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"files": files})
+	c.JSON(http.StatusOK, p.response(files, total))
 }
 
 // deleting file function
@@ -157,22 +281,24 @@ func DeleteFile(c *gin.Context) {
 	}
 	fileID := c.Param("id")
 
-	var ownerID, refCount int
-	var path string
-	var size int64
-	query := `SELECT user_id, path, ref_count, size FROM files WHERE id=$1`
-	err := db.DB.QueryRow(c, query, fileID).Scan(&ownerID, &path, &refCount, &size)
-
+	// Only the owner and co-owners can delete
+	f, err := authorizeFile(c, fileID, userID, accessManage)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		abortFileError(c, err)
 		return
 	}
 
-	if ownerID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot delete another user’s file"})
+	var refCount int
+	query := `SELECT ref_count FROM files WHERE id=$1`
+	err = db.DB.QueryRow(c, query, fileID).Scan(&refCount)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
 
+	// Uploads used to be merged into an existing row with the same
+	// content; such rows give up one reference at a time
 	if refCount > 1 {
 		_, err = db.DB.Exec(c, "UPDATE files SET ref_count=$1 WHERE id=$2", refCount-1, fileID)
 		if err != nil {
@@ -183,29 +309,37 @@ func DeleteFile(c *gin.Context) {
 		return
 	}
 
-	tx, err := db.DB.Begin(c)
+	// The last reference goes to the trash; its quota and blob are only
+	// given back when it is purged
+	_, err = db.DB.Exec(c, "UPDATE files SET deleted_at=CURRENT_TIMESTAMP, deleted_by=$1 WHERE id=$2", userID, f.ID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move file to trash"})
 		return
 	}
-	defer tx.Rollback(c)
-	// Delete record + file
-	_, err = db.DB.Exec(c, "DELETE FROM files WHERE id=$1", fileID)
+
+	c.JSON(http.StatusOK, gin.H{"status": "moved to trash", "purge_at": time.Now().Add(trashRetention())})
+}
+
+// removeFile deletes a files row and its versions inside tx, refunds their
+// size to whoever was charged for them and releases their blobs. It
+// returns the storage references to remove once tx commits.
+func removeFile(ctx context.Context, tx pgx.Tx, f *fileRecord) ([]string, error) {
+	// Earlier versions go first, each refunded and released like the file
+	orphans, err := pruneVersions(ctx, tx, f, 0)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB delete failed"})
-		return
+		return nil, err
 	}
-	_, err = tx.Exec(c, "UPDATE users SET storage_quota = storage_quota + $1 WHERE id=$2", size, userID)
+
+	var hash string
+	var size int64
+	err = tx.QueryRow(ctx, "DELETE FROM files WHERE id=$1 RETURNING hash, size", f.ID).Scan(&hash, &size)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore user quota"})
-		return
+		return nil, err
 	}
-	if err := tx.Commit(c); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
-		return
+	// The owner or group was charged for the file, whoever deletes it
+	if err := refundQuota(ctx, tx, f, size); err != nil {
+		return nil, err
 	}
-
-	os.Remove(path)
-
-	c.JSON(http.StatusOK, gin.H{"status": "file deleted"})
+	refs, err := blobs.Release(ctx, tx, hash)
+	return append(orphans, refs...), err
 }
@@ -0,0 +1,561 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Folders form one tree per user and one per group. A folder and
+// everything in it belong to the same space as its root: a user's personal
+// files, or a group's. Files outside any folder sit at the root.
+
+type folderRecord struct {
+	ID       int
+	OwnerID  int
+	GroupID  *int
+	ParentID *int
+	Name     string
+}
+
+// space identifies a folder tree: the user's own, or a group's.
+type space struct {
+	UserID  interface{}
+	GroupID *int
+}
+
+// filter is an SQL condition selecting rows of files or folders in the
+// space, with columns qualified by prefix and its placeholder numbered n.
+func (s space) filter(prefix string, n int) (string, interface{}) {
+	if s.GroupID != nil {
+		return fmt.Sprintf("%sgroup_id=$%d", prefix, n), *s.GroupID
+	}
+	return fmt.Sprintf("%suser_id=$%d AND %sgroup_id IS NULL", prefix, n, prefix), s.UserID
+}
+
+// lock serialises structural changes within the space for the rest of tx,
+// so two concurrent moves cannot build a cycle between them.
+func (s space) lock(ctx context.Context, tx pgx.Tx) error {
+	key := fmt.Sprintf("folders:u%v", s.UserID)
+	if s.GroupID != nil {
+		key = fmt.Sprintf("folders:g%d", *s.GroupID)
+	}
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", key)
+	return err
+}
+
+// spaceAccess is what userID may do with the folders of a space: everything
+// in their own, and in a group's what their membership role allows.
+func spaceAccess(c *gin.Context, userID interface{}, s space) (access, error) {
+	if s.GroupID == nil {
+		return accessManage, nil
+	}
+	role, err := groupRole(c, *s.GroupID, userID)
+	if err != nil {
+		return 0, err
+	}
+	return roleAccess[groupFileRole[role]], nil
+}
+
+// authorizeFolder loads a folder and checks that userID has at least the
+// wanted access to its space.
+func authorizeFolder(c *gin.Context, folderID interface{}, userID interface{}, want access) (*folderRecord, error) {
+	var f folderRecord
+	err := db.DB.QueryRow(c,
+		"SELECT id, user_id, group_id, parent_id, name FROM folders WHERE id=$1", folderID,
+	).Scan(&f.ID, &f.OwnerID, &f.GroupID, &f.ParentID, &f.Name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errFolderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.GroupID == nil && f.OwnerID != userID {
+		return nil, errFolderNotFound
+	}
+	got, err := spaceAccess(c, userID, f.space())
+	if err != nil {
+		return nil, err
+	}
+	if got == 0 {
+		return nil, errFolderNotFound
+	}
+	if got < want {
+		return nil, errFileDenied
+	}
+	return &f, nil
+}
+
+func (f *folderRecord) space() space {
+	return space{UserID: f.OwnerID, GroupID: f.GroupID}
+}
+
+// validName rejects names that cannot be a path component.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && len(name) <= 255 &&
+		!strings.ContainsAny(name, "/\x00")
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+type FolderInfo struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	ParentID  *int      `json:"parent_id"`
+	GroupID   *int      `json:"group_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateFolder creates a folder under parent_id, or at the root of the
+// user's space (or of group_id's).
+func CreateFolder(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	var req struct {
+		Name     string `json:"name"`
+		ParentID *int   `json:"parent_id"`
+		GroupID  *int   `json:"group_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !validName(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+		return
+	}
+
+	target := space{UserID: userID, GroupID: req.GroupID}
+	if req.ParentID != nil {
+		parent, err := authorizeFolder(c, *req.ParentID, userID, accessWrite)
+		if err != nil {
+			abortFileError(c, err)
+			return
+		}
+		target = parent.space()
+	} else if req.GroupID != nil {
+		if _, ok := requireGroupRole(c, strconv.Itoa(*req.GroupID), userID, groupMember, groupAdmin); !ok {
+			return
+		}
+	}
+
+	var folder FolderInfo
+	err := db.DB.QueryRow(c, `
+		INSERT INTO folders (user_id, group_id, parent_id, name) VALUES ($1, $2, $3, $4)
+		RETURNING id, name, parent_id, group_id, created_at`,
+		userID, target.GroupID, req.ParentID, req.Name,
+	).Scan(&folder.ID, &folder.Name, &folder.ParentID, &folder.GroupID, &folder.CreatedAt)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with that name already exists here"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, folder)
+}
+
+// GetFolder lists a folder's subfolders and files.
+func GetFolder(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	f, err := authorizeFolder(c, c.Param("id"), userID, accessRead)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	listFolder(c, f.space(), f)
+}
+
+// listFolder answers with the contents of folder, or of the space's root
+// when folder is nil.
+func listFolder(c *gin.Context, s space, folder *folderRecord) {
+	var parentID *int
+	path := "/"
+	if folder != nil {
+		parentID = &folder.ID
+		var err error
+		if path, err = folderPath(c, folder.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve folder path"})
+			return
+		}
+	}
+
+	cond, arg := s.filter("", 1)
+	rows, err := db.DB.Query(c, `
+		SELECT id, name, parent_id, group_id, created_at FROM folders
+		WHERE `+cond+` AND parent_id IS NOT DISTINCT FROM $2
+		ORDER BY name`, arg, parentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch folders"})
+		return
+	}
+	folders := []FolderInfo{}
+	for rows.Next() {
+		var f FolderInfo
+		if err := rows.Scan(&f.ID, &f.Name, &f.ParentID, &f.GroupID, &f.CreatedAt); err != nil {
+			rows.Close()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan folder data"})
+			return
+		}
+		folders = append(folders, f)
+	}
+	rows.Close()
+
+	fileCond, _ := s.filter("f.", 1)
+	rows, err = db.DB.Query(c, `
+		SELECT f.id, f.filename, f.mime_type, f.size, f.upload_date, f.ref_count, f.visibility, f.download_count, f.owner_download_count,
+		       COALESCE(f.tags, '{}'), COALESCE(b.integrity NOT IN ('corrupt', 'missing'), true)
+		FROM files f
+		LEFT JOIN blobs b ON b.hash = f.hash
+		WHERE `+fileCond+` AND f.folder_id IS NOT DISTINCT FROM $2 AND f.deleted_at IS NULL
+		ORDER BY f.filename, f.upload_date DESC`, arg, parentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+	defer rows.Close()
+	files := []FileInfo{}
+	for rows.Next() {
+		var file FileInfo
+		if err := rows.Scan(&file.ID, &file.Filename, &file.MimeType, &file.Size, &file.UploadDate,
+			&file.RefCount, &file.Visibility, &file.DownloadCount, &file.OwnerDownloadCount, &file.Tags, &file.Available); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan file data"})
+			return
+		}
+		file.FolderID = parentID
+		files = append(files, file)
+	}
+
+	var info *FolderInfo
+	if folder != nil {
+		info = &FolderInfo{ID: folder.ID, Name: folder.Name, ParentID: folder.ParentID, GroupID: folder.GroupID}
+	}
+	c.JSON(http.StatusOK, gin.H{"folder": info, "path": path, "folders": folders, "files": files})
+}
+
+// folderPath returns the folder's path from its root, like "/projects/2025".
+func folderPath(ctx context.Context, folderID int) (string, error) {
+	var path string
+	err := db.DB.QueryRow(ctx, `
+		WITH RECURSIVE up AS (
+			SELECT id, parent_id, name, 0 AS depth FROM folders WHERE id=$1
+			UNION ALL
+			SELECT f.id, f.parent_id, f.name, up.depth + 1 FROM folders f JOIN up ON f.id = up.parent_id
+		)
+		SELECT '/' || string_agg(name, '/' ORDER BY depth DESC) FROM up`, folderID).Scan(&path)
+	return path, err
+}
+
+// UpdateFolder renames a folder and/or moves it under parent_id (0 for the
+// root of its space). A folder cannot be moved into itself or one of its
+// descendants.
+func UpdateFolder(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	var req struct {
+		Name     *string `json:"name"`
+		ParentID *int    `json:"parent_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Name == nil && req.ParentID == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+	if req.Name != nil && !validName(*req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid folder name"})
+		return
+	}
+
+	f, err := authorizeFolder(c, c.Param("id"), userID, accessWrite)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	name, parentID := f.Name, f.ParentID
+	if req.Name != nil {
+		name = *req.Name
+	}
+	if req.ParentID != nil {
+		parentID = nil
+		if *req.ParentID != 0 {
+			parent, err := authorizeFolder(c, *req.ParentID, userID, accessWrite)
+			if err != nil {
+				abortFileError(c, err)
+				return
+			}
+			if !sameSpace(parent.space(), f.space()) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Folders can only be moved within the same space"})
+				return
+			}
+			parentID = &parent.ID
+		}
+	}
+
+	tx, err := db.DB.Begin(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(c)
+	if err := f.space().lock(c, tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder"})
+		return
+	}
+
+	if parentID != nil {
+		var cycle bool
+		err := tx.QueryRow(c, `
+			WITH RECURSIVE up AS (
+				SELECT id, parent_id FROM folders WHERE id=$1
+				UNION ALL
+				SELECT f.id, f.parent_id FROM folders f JOIN up ON f.id = up.parent_id
+			)
+			SELECT EXISTS (SELECT 1 FROM up WHERE id=$2)`, *parentID, f.ID).Scan(&cycle)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder"})
+			return
+		}
+		if cycle {
+			c.JSON(http.StatusConflict, gin.H{"error": "A folder cannot be moved into itself or one of its subfolders"})
+			return
+		}
+	}
+
+	_, err = tx.Exec(c, "UPDATE folders SET name=$1, parent_id=$2 WHERE id=$3", name, parentID, f.ID)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A folder with that name already exists there"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update folder"})
+		return
+	}
+	if err := tx.Commit(c); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, FolderInfo{ID: f.ID, Name: name, ParentID: parentID, GroupID: f.GroupID})
+}
+
+func sameSpace(a, b space) bool {
+	if a.GroupID != nil || b.GroupID != nil {
+		return a.GroupID != nil && b.GroupID != nil && *a.GroupID == *b.GroupID
+	}
+	return a.UserID == b.UserID
+}
+
+// DeleteFolder deletes a folder with all its subfolders and moves their
+// files to the trash. Restored files come back at the root of the space.
+func DeleteFolder(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	f, err := authorizeFolder(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	tx, err := db.DB.Begin(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(c)
+	if err := f.space().lock(c, tx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
+
+	// Files already in the trash lose their folder too
+	var trashed int
+	err = tx.QueryRow(c, `
+		WITH RECURSIVE sub AS (
+			SELECT id FROM folders WHERE id=$1
+			UNION ALL
+			SELECT f.id FROM folders f JOIN sub ON f.parent_id = sub.id
+		), moved AS (
+			UPDATE files SET folder_id = NULL,
+			       deleted_by = CASE WHEN deleted_at IS NULL THEN $2 ELSE deleted_by END,
+			       deleted_at = COALESCE(deleted_at, CURRENT_TIMESTAMP)
+			WHERE folder_id IN (SELECT id FROM sub)
+			RETURNING 1
+		)
+		SELECT COUNT(*) FROM moved`, f.ID, userID).Scan(&trashed)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move folder contents to trash"})
+		return
+	}
+
+	// Subfolders go with it through ON DELETE CASCADE
+	tag, err := tx.Exec(c, "DELETE FROM folders WHERE id=$1", f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete folder"})
+		return
+	}
+	if err := tx.Commit(c); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "folder deleted",
+		"trashed": trashed,
+		"folders": tag.RowsAffected(),
+	})
+}
+
+// UpdateFile renames a file and/or moves it into folder_id (0 for the root
+// of its space).
+func UpdateFile(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	var req struct {
+		Filename *string `json:"filename"`
+		FolderID *int    `json:"folder_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Filename == nil && req.FolderID == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+	if req.Filename != nil && !validName(*req.Filename) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+		return
+	}
+
+	f, err := authorizeFile(c, c.Param("id"), userID, accessWrite)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	filename, folderID := f.Filename, f.FolderID
+	if req.Filename != nil {
+		filename = *req.Filename
+	}
+	if req.FolderID != nil {
+		fileSpace := space{UserID: f.OwnerID, GroupID: f.GroupID}
+		folderID = nil
+		if *req.FolderID != 0 {
+			folder, err := authorizeFolder(c, *req.FolderID, userID, accessWrite)
+			if err != nil {
+				abortFileError(c, err)
+				return
+			}
+			if !sameSpace(folder.space(), fileSpace) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Files can only be moved within the same space"})
+				return
+			}
+			folderID = &folder.ID
+		} else if got, err := spaceAccess(c, userID, fileSpace); err != nil || got < accessWrite || (f.GroupID == nil && f.OwnerID != userID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You cannot move this file"})
+			return
+		}
+	}
+
+	_, err = db.DB.Exec(c, "UPDATE files SET filename=$1, folder_id=$2 WHERE id=$3", filename, folderID, f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": f.ID, "filename": filename, "folder_id": folderID})
+}
+
+// BrowsePath resolves a path like /projects/2025/report.pdf in the user's
+// space, or with ?group_id= in a group's. A path naming a folder lists it;
+// one naming a file returns its details, or its content with ?download=true.
+// When several files share a name the newest wins.
+func BrowsePath(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	s := space{UserID: userID}
+	if raw := c.Query("group_id"); raw != "" {
+		groupID, ok := requireGroupRole(c, raw, userID)
+		if !ok {
+			return
+		}
+		s.GroupID = &groupID
+	}
+
+	var parts []string
+	for _, p := range strings.Split(c.Param("path"), "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		listFolder(c, s, nil)
+		return
+	}
+
+	cond, arg := s.filter("", 1)
+	var folder *folderRecord
+	for i, name := range parts {
+		var parentID *int
+		if folder != nil {
+			parentID = &folder.ID
+		}
+		var next folderRecord
+		err := db.DB.QueryRow(c, `
+			SELECT id, user_id, group_id, parent_id, name FROM folders
+			WHERE `+cond+` AND parent_id IS NOT DISTINCT FROM $2 AND name=$3`, arg, parentID, name,
+		).Scan(&next.ID, &next.OwnerID, &next.GroupID, &next.ParentID, &next.Name)
+		if err == nil {
+			folder = &next
+			continue
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve path"})
+			return
+		}
+		// Only the last component may name a file
+		if i == len(parts)-1 {
+			browseFile(c, cond, arg, parentID, name)
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
+		return
+	}
+	listFolder(c, s, folder)
+}
+
+func browseFile(c *gin.Context, cond string, arg interface{}, folderID *int, name string) {
+	var id int
+	err := db.DB.QueryRow(c, `
+		SELECT id FROM files
+		WHERE `+cond+` AND folder_id IS NOT DISTINCT FROM $2 AND filename=$3 AND deleted_at IS NULL
+		ORDER BY upload_date DESC LIMIT 1`, arg, folderID, name).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve path"})
+		return
+	}
+
+	if c.Query("download") == "true" {
+		c.Params = append(c.Params, gin.Param{Key: "id", Value: strconv.Itoa(id)})
+		serveOwnFile(c, true)
+		return
+	}
+
+	var file FileInfo
+	err = db.DB.QueryRow(c, `
+		SELECT f.id, f.filename, f.mime_type, f.size, f.upload_date, f.ref_count, f.visibility, f.download_count, f.owner_download_count, f.folder_id,
+		       COALESCE(f.tags, '{}'), COALESCE(b.integrity NOT IN ('corrupt', 'missing'), true)
+		FROM files f
+		LEFT JOIN blobs b ON b.hash = f.hash
+		WHERE f.id=$1`, id,
+	).Scan(&file.ID, &file.Filename, &file.MimeType, &file.Size, &file.UploadDate, &file.RefCount,
+		&file.Visibility, &file.DownloadCount, &file.OwnerDownloadCount, &file.FolderID, &file.Tags, &file.Available)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch file"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file": file})
+}
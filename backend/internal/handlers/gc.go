@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/gc"
+	"github.com/gin-gonic/gin"
+)
+
+// AdminGCReport shows what a garbage collection would do without changing
+// anything.
+func AdminGCReport(c *gin.Context) {
+	runGC(c, true)
+}
+
+// AdminRunGC runs a garbage collection now. Pass ?dry_run=true to only
+// report.
+func AdminRunGC(c *gin.Context) {
+	runGC(c, c.Query("dry_run") == "true")
+}
+
+func runGC(c *gin.Context, dryRun bool) {
+	report, err := gc.Run(c, dryRun)
+	if errors.Is(err, gc.ErrBusy) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Garbage collection failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Garbage collection failed"})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+type Grant struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type GroupGrant struct {
+	GroupID   int       `json:"group_id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListGrants lists the users and groups a file is shared with. Like the
+// grants themselves, the list is only for those who manage the file.
+func ListGrants(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	rows, err := db.DB.Query(c, `
+		SELECT g.user_id, u.username, g.role, g.created_at
+		FROM file_grants g
+		JOIN users u ON u.id = g.user_id
+		WHERE g.file_id=$1
+		ORDER BY u.username`, f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch grants"})
+		return
+	}
+	defer rows.Close()
+
+	grants := []Grant{}
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.UserID, &g.Username, &g.Role, &g.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan grant data"})
+			return
+		}
+		grants = append(grants, g)
+	}
+	rows.Close()
+
+	rows, err = db.DB.Query(c, `
+		SELECT gg.group_id, g.name, gg.role, gg.created_at
+		FROM group_grants gg
+		JOIN groups g ON g.id = gg.group_id
+		WHERE gg.file_id=$1
+		ORDER BY g.name`, f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch grants"})
+		return
+	}
+	defer rows.Close()
+
+	groups := []GroupGrant{}
+	for rows.Next() {
+		var g GroupGrant
+		if err := rows.Scan(&g.GroupID, &g.Name, &g.Role, &g.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan grant data"})
+			return
+		}
+		groups = append(groups, g)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"grants": grants, "groups": groups})
+}
+
+// GrantAccess shares a file with another user, or with every member of a
+// group when group_id is given instead of username, or changes the role of
+// an existing grant.
+func GrantAccess(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		GroupID  int    `json:"group_id"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Username == "") == (req.GroupID == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+	if req.Role != roleViewer && req.Role != roleEditor && req.Role != roleCoOwner {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be viewer, editor or co-owner"})
+		return
+	}
+
+	f, err := authorizeFile(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	if req.GroupID != 0 {
+		grantToGroup(c, f, userID, req.GroupID, req.Role)
+		return
+	}
+
+	var granteeID int
+	err = db.DB.QueryRow(c, "SELECT id FROM users WHERE username=$1", req.Username).Scan(&granteeID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+	if granteeID == f.OwnerID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The owner already has full access"})
+		return
+	}
+
+	_, err = db.DB.Exec(c, `
+		INSERT INTO file_grants (file_id, user_id, role, granted_by) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (file_id, user_id) DO UPDATE SET role = EXCLUDED.role, granted_by = EXCLUDED.granted_by`,
+		f.ID, granteeID, req.Role, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to share file"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "shared", "user_id": granteeID, "role": req.Role})
+}
+
+// grantToGroup shares f with a group. Sharing with a group the user is not
+// in is allowed, as with users; the group only needs to exist.
+func grantToGroup(c *gin.Context, f *fileRecord, userID interface{}, groupID int, role string) {
+	tag, err := db.DB.Exec(c, `
+		INSERT INTO group_grants (file_id, group_id, role, granted_by)
+		SELECT $1, id, $3, $4 FROM groups WHERE id=$2
+		ON CONFLICT (file_id, group_id) DO UPDATE SET role = EXCLUDED.role, granted_by = EXCLUDED.granted_by`,
+		f.ID, groupID, role, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to share file"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "shared", "group_id": groupID, "role": role})
+}
+
+// RevokeAccess stops sharing a file with a user. Users may also remove
+// their own grant to drop a file from "shared with me".
+func RevokeAccess(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	granteeID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+
+	want := accessManage
+	if granteeID == userID {
+		want = accessRead
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, want)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	tag, err := db.DB.Exec(c, "DELETE FROM file_grants WHERE file_id=$1 AND user_id=$2", f.ID, granteeID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Grant not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+// RevokeGroupAccess stops sharing a file with a group.
+func RevokeGroupAccess(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	tag, err := db.DB.Exec(c, "DELETE FROM group_grants WHERE file_id=$1 AND group_id=$2", f.ID, c.Param("groupId"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Grant not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+type SharedFileInfo struct {
+	ID         int       `json:"id"`
+	Filename   string    `json:"filename"`
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	UploadDate time.Time `json:"upload_date"`
+	Owner      string    `json:"owner"`
+	Role       string    `json:"role"`
+	Group      *string   `json:"group"` // set when shared through one of the caller's groups
+	SharedAt   time.Time `json:"shared_at"`
+}
+
+// ListSharedWithMe lists files shared with the caller directly or through
+// one of their groups. Files that belong to a group are listed with
+// ?group_id= on /api/files instead.
+func ListSharedWithMe(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	rows, err := db.DB.Query(c, `
+		SELECT f.id, f.filename, f.mime_type, f.size, f.upload_date, u.username, s.role, s.group_name, s.created_at
+		FROM (
+			SELECT file_id, role, NULL::varchar AS group_name, created_at
+			FROM file_grants WHERE user_id=$1
+			UNION ALL
+			SELECT gg.file_id, gg.role, g.name, gg.created_at
+			FROM group_grants gg
+			JOIN groups g ON g.id = gg.group_id
+			JOIN group_members m ON m.group_id = gg.group_id AND m.user_id=$1
+		) s
+		JOIN files f ON f.id = s.file_id
+		JOIN users u ON u.id = f.user_id
+		WHERE f.deleted_at IS NULL
+		ORDER BY s.created_at DESC`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch files"})
+		return
+	}
+	defer rows.Close()
+
+	files := []SharedFileInfo{}
+	for rows.Next() {
+		var f SharedFileInfo
+		if err := rows.Scan(&f.ID, &f.Filename, &f.MimeType, &f.Size, &f.UploadDate, &f.Owner, &f.Role, &f.Group, &f.SharedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan file data"})
+			return
+		}
+		files = append(files, f)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"files": files})
+}
@@ -0,0 +1,447 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Groups are shared spaces. Files uploaded into a group belong to it and
+// are charged to its pooled quota instead of the uploader's; every member
+// can see them, with what else they may do set by their membership role.
+
+// groupRole returns userID's role in the group, or "" if they are not a
+// member or the group does not exist.
+func groupRole(c *gin.Context, groupID int, userID interface{}) (string, error) {
+	var role string
+	err := db.DB.QueryRow(c,
+		"SELECT role FROM group_members WHERE group_id=$1 AND user_id=$2", groupID, userID,
+	).Scan(&role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// requireGroupRole parses the group id in raw and checks that userID is a
+// member with one of the given roles (any role when none are given),
+// answering the request itself when not.
+func requireGroupRole(c *gin.Context, raw string, userID interface{}, roles ...string) (int, bool) {
+	groupID, err := strconv.Atoi(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group id"})
+		return 0, false
+	}
+	role, err := groupRole(c, groupID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group membership"})
+		return 0, false
+	}
+	if role == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return 0, false
+	}
+	if len(roles) == 0 {
+		return groupID, true
+	}
+	for _, r := range roles {
+		if r == role {
+			return groupID, true
+		}
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Your group role does not allow this"})
+	return 0, false
+}
+
+// resolveUploadTarget picks who pays for an upload from its parameters:
+// the user, or the group in group_id, which they must be allowed to upload
+// into. folder_id optionally places the file in a folder of that same
+// space. version_of makes the upload a new version of a file the user may
+// edit, charged to whoever pays for that file. tags is a comma separated
+// list of tags for the file.
+func resolveUploadTarget(c *gin.Context, userID interface{}, param func(string) string) (uploadTarget, bool) {
+	tags, err := splitTags(param("tags"))
+	if err == nil && len(tags) > maxTagsPerFile {
+		err = errTooManyTags
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return uploadTarget{}, false
+	}
+
+	if raw := param("version_of"); raw != "" {
+		f, err := authorizeFile(c, raw, userID, accessWrite)
+		if err != nil {
+			abortFileError(c, err)
+			return uploadTarget{}, false
+		}
+		return uploadTarget{UserID: f.OwnerID, GroupID: f.GroupID, FolderID: f.FolderID, VersionOf: f, Tags: tags}, true
+	}
+
+	target := uploadTarget{UserID: userID, Tags: tags}
+	if raw := param("group_id"); raw != "" {
+		groupID, ok := requireGroupRole(c, raw, userID, groupMember, groupAdmin)
+		if !ok {
+			return uploadTarget{}, false
+		}
+		target.GroupID = &groupID
+	}
+	rawFolderID := param("folder_id")
+	if rawFolderID == "" {
+		return target, true
+	}
+
+	// The folder must be one the user may add to, in the same space
+	folder, err := authorizeFolder(c, rawFolderID, userID, accessWrite)
+	if err != nil {
+		abortFileError(c, err)
+		return uploadTarget{}, false
+	}
+	if !sameSpace(folder.space(), space{UserID: userID, GroupID: target.GroupID}) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Folder belongs to a different space"})
+		return uploadTarget{}, false
+	}
+	target.FolderID = &folder.ID
+	return target, true
+}
+
+// fileScope is the SQL condition selecting the files a listing or search
+// covers: the user's personal files, or with ?group_id= the files of a
+// group they belong to, outside the trash. Its placeholder is $1.
+func fileScope(c *gin.Context, userID interface{}) (string, []interface{}, bool) {
+	scope, args, ok := spaceScope(c, userID)
+	return scope + " AND deleted_at IS NULL", args, ok
+}
+
+// spaceScope is fileScope including the trash.
+func spaceScope(c *gin.Context, userID interface{}) (string, []interface{}, bool) {
+	raw := c.Query("group_id")
+	if raw == "" {
+		return "user_id=$1 AND group_id IS NULL", []interface{}{userID}, true
+	}
+	groupID, ok := requireGroupRole(c, raw, userID)
+	if !ok {
+		return "", nil, false
+	}
+	return "group_id=$1", []interface{}{groupID}, true
+}
+
+// defaultGroupQuota is the pool a new group starts with, from
+// GROUP_STORAGE_QUOTA in bytes (default 100 MB).
+func defaultGroupQuota() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("GROUP_STORAGE_QUOTA"), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	return 100 << 20
+}
+
+type GroupInfo struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	Role         string    `json:"role"`
+	StorageQuota int64     `json:"storage_quota"`
+	Used         int64     `json:"used"`
+	Members      int       `json:"members"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CreateGroup creates a group with the caller as its admin.
+func CreateGroup(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" || len(req.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+
+	tx, err := db.DB.Begin(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(c)
+
+	var id int
+	err = tx.QueryRow(c, `
+		INSERT INTO groups (name, storage_quota, created_by) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO NOTHING RETURNING id`,
+		req.Name, defaultGroupQuota(), userID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A group with that name already exists"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+	_, err = tx.Exec(c, "INSERT INTO group_members (group_id, user_id, role) VALUES ($1, $2, $3)", id, userID, groupAdmin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+		return
+	}
+	if err := tx.Commit(c); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "name": req.Name, "storage_quota": defaultGroupQuota()})
+}
+
+const groupInfoQuery = `
+	SELECT g.id, g.name, m.role, g.storage_quota,
+	       (SELECT COALESCE(SUM(size), 0) FROM files WHERE group_id = g.id)
+	       + (SELECT COALESCE(SUM(v.size), 0) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.group_id = g.id),
+	       (SELECT COUNT(*) FROM group_members WHERE group_id = g.id),
+	       g.created_at
+	FROM groups g
+	JOIN group_members m ON m.group_id = g.id AND m.user_id = $1`
+
+func scanGroupInfo(row pgx.Row) (GroupInfo, error) {
+	var g GroupInfo
+	err := row.Scan(&g.ID, &g.Name, &g.Role, &g.StorageQuota, &g.Used, &g.Members, &g.CreatedAt)
+	return g, err
+}
+
+// ListGroups lists the groups the caller belongs to.
+func ListGroups(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+
+	rows, err := db.DB.Query(c, groupInfoQuery+" ORDER BY g.name", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
+		return
+	}
+	defer rows.Close()
+
+	groups := []GroupInfo{}
+	for rows.Next() {
+		g, err := scanGroupInfo(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan group data"})
+			return
+		}
+		groups = append(groups, g)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"groups": groups})
+}
+
+type GroupMember struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// GetGroup shows a group the caller belongs to, with its members.
+func GetGroup(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	groupID, ok := requireGroupRole(c, c.Param("id"), userID)
+	if !ok {
+		return
+	}
+
+	g, err := scanGroupInfo(db.DB.QueryRow(c, groupInfoQuery+" WHERE g.id=$2", userID, groupID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group"})
+		return
+	}
+
+	rows, err := db.DB.Query(c, `
+		SELECT m.user_id, u.username, m.role, m.joined_at
+		FROM group_members m JOIN users u ON u.id = m.user_id
+		WHERE m.group_id=$1
+		ORDER BY u.username`, groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch members"})
+		return
+	}
+	defer rows.Close()
+
+	members := []GroupMember{}
+	for rows.Next() {
+		var m GroupMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.JoinedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan member data"})
+			return
+		}
+		members = append(members, m)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"group": g, "members": members})
+}
+
+// SetGroupMember adds a user to a group or changes their role. Group admins
+// only.
+func SetGroupMember(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	var req struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = groupMember
+	}
+	if req.Role != groupViewer && req.Role != groupMember && req.Role != groupAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be viewer, member or admin"})
+		return
+	}
+	groupID, ok := requireGroupRole(c, c.Param("id"), userID, groupAdmin)
+	if !ok {
+		return
+	}
+
+	var memberID int
+	err := db.DB.QueryRow(c, "SELECT id FROM users WHERE username=$1", req.Username).Scan(&memberID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up user"})
+		return
+	}
+	if memberID == userID && req.Role != groupAdmin {
+		if ok := otherAdminExists(c, groupID, memberID); !ok {
+			return
+		}
+	}
+
+	_, err = db.DB.Exec(c, `
+		INSERT INTO group_members (group_id, user_id, role) VALUES ($1, $2, $3)
+		ON CONFLICT (group_id, user_id) DO UPDATE SET role = EXCLUDED.role`,
+		groupID, memberID, req.Role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update membership"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "updated", "user_id": memberID, "role": req.Role})
+}
+
+// RemoveGroupMember removes a user from a group. Admins can remove anyone;
+// members can leave. Files they uploaded stay with the group.
+func RemoveGroupMember(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	memberID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+
+	var groupID int
+	var ok bool
+	if memberID == userID {
+		groupID, ok = requireGroupRole(c, c.Param("id"), userID)
+		if ok {
+			ok = otherAdminExists(c, groupID, memberID)
+		}
+	} else {
+		groupID, ok = requireGroupRole(c, c.Param("id"), userID, groupAdmin)
+	}
+	if !ok {
+		return
+	}
+
+	tag, err := db.DB.Exec(c, "DELETE FROM group_members WHERE group_id=$1 AND user_id=$2", groupID, memberID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "removed"})
+}
+
+// otherAdminExists refuses to let the last admin of a group step down,
+// which would leave nobody able to manage it.
+func otherAdminExists(c *gin.Context, groupID, userID int) bool {
+	var role string
+	var others int
+	err := db.DB.QueryRow(c, `
+		SELECT COALESCE((SELECT role FROM group_members WHERE group_id=$1 AND user_id=$2), ''),
+		       (SELECT COUNT(*) FROM group_members WHERE group_id=$1 AND role='admin' AND user_id<>$2)`,
+		groupID, userID).Scan(&role, &others)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group admins"})
+		return false
+	}
+	if role == groupAdmin && others == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A group needs at least one admin"})
+		return false
+	}
+	return true
+}
+
+// DeleteGroup deletes an empty group. Group admins only.
+func DeleteGroup(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	groupID, ok := requireGroupRole(c, c.Param("id"), userID, groupAdmin)
+	if !ok {
+		return
+	}
+
+	var files int
+	if err := db.DB.QueryRow(c, "SELECT COUNT(*) FROM files WHERE group_id=$1", groupID).Scan(&files); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+		return
+	}
+	if files > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Delete the group's files and empty its trash first", "files": files})
+		return
+	}
+	if _, err := db.DB.Exec(c, "DELETE FROM groups WHERE id=$1", groupID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// AdminSetGroupQuota sets the total size of a group's storage pool; the
+// remaining quota becomes that minus what its files already use.
+func AdminSetGroupQuota(c *gin.Context) {
+	var req struct {
+		Limit *int64 `json:"limit"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Limit == nil || *req.Limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+		return
+	}
+
+	var remaining int64
+	err := db.DB.QueryRow(c, `
+		UPDATE groups SET storage_quota = $1 - (SELECT COALESCE(SUM(size), 0) FROM files WHERE group_id = groups.id)
+			- (SELECT COALESCE(SUM(v.size), 0) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.group_id = groups.id)
+		WHERE id=$2 RETURNING storage_quota`,
+		*req.Limit, c.Param("id")).Scan(&remaining)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update quota"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"limit": *req.Limit, "storage_quota": remaining})
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/scrub"
+	"github.com/gin-gonic/gin"
+)
+
+type damagedFile struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+	Owner    string `json:"owner"`
+}
+
+type damagedBlob struct {
+	Hash       string        `json:"hash"`
+	Size       int64         `json:"size"`
+	Integrity  string        `json:"integrity"`
+	Error      string        `json:"error"`
+	VerifiedAt time.Time     `json:"verified_at"`
+	Files      []damagedFile `json:"files"`
+}
+
+// AdminIntegrity reports the scrubber's findings: how many blobs are in
+// each state and every blob that failed, with the files that use it.
+func AdminIntegrity(c *gin.Context) {
+	var ok, corrupt, missing, unverified int64
+	err := db.DB.QueryRow(c, `
+		SELECT
+			COUNT(*) FILTER (WHERE integrity = 'ok'),
+			COUNT(*) FILTER (WHERE integrity = 'corrupt'),
+			COUNT(*) FILTER (WHERE integrity = 'missing'),
+			COUNT(*) FILTER (WHERE verified_at IS NULL)
+		FROM blobs`).Scan(&ok, &corrupt, &missing, &unverified)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load integrity summary"})
+		return
+	}
+
+	rows, err := db.DB.Query(c, `
+		SELECT b.hash, b.size, b.integrity, COALESCE(b.integrity_error, ''), b.verified_at,
+		       f.id, f.filename, COALESCE(u.username, '')
+		FROM blobs b
+		JOIN files f ON f.hash = b.hash
+		LEFT JOIN users u ON u.id = f.user_id
+		WHERE b.integrity IN ('corrupt', 'missing')
+		ORDER BY b.verified_at DESC, b.hash, f.id`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB query failed"})
+		return
+	}
+	defer rows.Close()
+
+	damaged := []*damagedBlob{}
+	for rows.Next() {
+		var b damagedBlob
+		var f damagedFile
+		if err := rows.Scan(&b.Hash, &b.Size, &b.Integrity, &b.Error, &b.VerifiedAt, &f.ID, &f.Filename, &f.Owner); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Scan failed"})
+			return
+		}
+		if n := len(damaged); n > 0 && damaged[n-1].Hash == b.Hash {
+			damaged[n-1].Files = append(damaged[n-1].Files, f)
+			continue
+		}
+		b.Files = []damagedFile{f}
+		damaged = append(damaged, &b)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":         ok,
+		"corrupt":    corrupt,
+		"missing":    missing,
+		"unverified": unverified,
+		"last_pass":  scrub.Last(),
+		"damaged":    damaged,
+	})
+}
+
+// AdminStartScrub starts an integrity pass now instead of waiting for the
+// schedule.
+func AdminStartScrub(c *gin.Context) {
+	if !scrub.Trigger() {
+		c.JSON(http.StatusConflict, gin.H{"error": scrub.ErrBusy.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Integrity scrub started"})
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Page is the response of every paginated listing. NextCursor, passed back
+// as ?cursor= with the same sort, continues after the last item and is
+// empty on the last page. Total counts every match, not just this page.
+type Page struct {
+	Items      interface{} `json:"items"`
+	Total      int         `json:"total"`
+	Sort       string      `json:"sort"`
+	Order      string      `json:"order"`
+	Limit      int         `json:"limit"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// sortKey is a ?sort= value: the expression rows are ordered by and the
+// type a cursor's value is cast back to.
+type sortKey struct {
+	expr string
+	cast string
+}
+
+// fileSorts are the sorts every file listing accepts, over files aliased f.
+func fileSorts() map[string]sortKey {
+	return map[string]sortKey{
+		"name":      {"f.filename", "text"},
+		"size":      {"f.size", "bigint"},
+		"date":      {"COALESCE(f.upload_date, '-infinity')", "timestamp"},
+		"downloads": {"COALESCE(f.download_count, 0)", "integer"},
+	}
+}
+
+// cursor is the position of the last row of a page: its sort value as
+// text and its id, which breaks ties.
+type cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func (cur cursor) encode() string {
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// page is the window a request asks for with ?sort=, ?order=, ?limit= and
+// ?cursor=, and collects the cursor for the next one while rows are read.
+type page struct {
+	sort  string
+	key   sortKey
+	desc  bool
+	limit int
+	after *cursor
+
+	seen int
+	more bool
+	last cursor
+}
+
+// parsePage reads the paging parameters, responding 400 when they are
+// invalid. Name sorts ascending by default, everything else descending.
+func parsePage(c *gin.Context, sorts map[string]sortKey, defaultSort string) (*page, bool) {
+	p := &page{sort: c.DefaultQuery("sort", defaultSort), limit: defaultPageSize}
+	key, ok := sorts[p.sort]
+	if !ok {
+		names := make([]string, 0, len(sorts))
+		for name := range sorts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of " + strings.Join(names, ", ")})
+		return nil, false
+	}
+	p.key = key
+
+	switch c.Query("order") {
+	case "":
+		p.desc = p.sort != "name"
+	case "asc":
+	case "desc":
+		p.desc = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "order must be asc or desc"})
+		return nil, false
+	}
+
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+			return nil, false
+		}
+		p.limit = n
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		var cur cursor
+		data, err := base64.RawURLEncoding.DecodeString(raw)
+		if err == nil {
+			err = json.Unmarshal(data, &cur)
+		}
+		// A cursor only means something under the sort it was made for
+		if err != nil || cur.Sort != p.sort || cur.Desc != p.desc {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor for this sort"})
+			return nil, false
+		}
+		p.after = &cur
+	}
+	return p, true
+}
+
+// done is called for each row before scanning it and reports whether the
+// page is already full, in which case the row only shows there is more.
+func (p *page) done() bool {
+	if p.seen == p.limit {
+		p.more = true
+		return true
+	}
+	p.seen++
+	return false
+}
+
+// scan reads a row into dest, and the two columns run appends into the
+// cursor for the next page.
+func (p *page) scan(rows pgx.Rows, dest ...interface{}) error {
+	return rows.Scan(append(dest, &p.last.Value, &p.last.ID)...)
+}
+
+// response wraps a page of items in the shared envelope.
+func (p *page) response(items interface{}, total int) Page {
+	res := Page{Items: items, Total: total, Sort: p.sort, Order: "asc", Limit: p.limit}
+	if p.desc {
+		res.Order = "desc"
+	}
+	if p.more {
+		p.last.Sort, p.last.Desc = p.sort, p.desc
+		res.NextCursor = p.last.encode()
+	}
+	return res
+}
+
+// listQuery builds a filtered query over files, aliased f, numbering
+// placeholders as arguments are added. Conditions are added first; columns
+// that take arguments are added after them, so the count can leave those
+// out.
+type listQuery struct {
+	from       string
+	where      []string
+	args       []interface{}
+	filterArgs int
+}
+
+// newListQuery starts a query from the given tables with one condition,
+// such as a scope, already numbered for args.
+func newListQuery(from, cond string, args ...interface{}) *listQuery {
+	q := &listQuery{from: from, args: args}
+	if cond != "" {
+		q.and(cond)
+	}
+	return q
+}
+
+// arg adds a value and returns its placeholder.
+func (q *listQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// and adds a condition.
+func (q *listQuery) and(cond string) {
+	q.where = append(q.where, cond)
+	q.filterArgs = len(q.args)
+}
+
+func whereSQL(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// run counts every match, then selects the columns of the page p asks for,
+// followed by the sort value and f.id for p to continue from.
+func (q *listQuery) run(ctx context.Context, columns string, p *page) (pgx.Rows, int, error) {
+	var total int
+	err := db.DB.QueryRow(ctx, "SELECT count(*) FROM "+q.from+whereSQL(q.where), q.args[:q.filterArgs]...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	op, dir := ">", "ASC"
+	if p.desc {
+		op, dir = "<", "DESC"
+	}
+	where := q.where[:len(q.where):len(q.where)]
+	if p.after != nil {
+		where = append(where, fmt.Sprintf("(%s, f.id) %s (CAST(%s::text AS %s), %s)",
+			p.key.expr, op, q.arg(p.after.Value), p.key.cast, q.arg(p.after.ID)))
+	}
+	query := fmt.Sprintf("SELECT %s, (%s)::text, f.id FROM %s%s ORDER BY %s %s, f.id %s LIMIT %d",
+		columns, p.key.expr, q.from, whereSQL(where), p.key.expr, dir, dir, p.limit+1)
+
+	rows, err := db.DB.Query(ctx, query, q.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rows, total, nil
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"fmt"
+	"html"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -10,7 +12,16 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/lib/pq"
 
-	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/extract"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/searchql"
+)
+
+// Snippets mark matches with control characters, which extracted text
+// never contains, so they can be swapped for tags after escaping the rest.
+const (
+    snippetOptions = "StartSel=\x02, StopSel=\x03, MaxFragments=2, MaxWords=25, MinWords=8, FragmentDelimiter=\" ... \""
+    snippetStart   = "\x02"
+    snippetStop    = "\x03"
 )
 
 func SearchFiles(c *gin.Context) {
@@ -20,6 +31,104 @@ func SearchFiles(c *gin.Context) {
         return
     }
 
+    // Personal files, or a group's with ?group_id=
+    scope, scopeArgs, ok := fileScope(c, userID)
+    if !ok {
+        return
+    }
+    query := newListQuery("files f", scope, scopeArgs...)
+    if !searchFilters(c, query) {
+        return
+    }
+
+    // With q, rank by how well the document text matches and show where
+    columns := `f.id, f.filename, f.mime_type, f.size, f.hash, f.upload_date, f.ref_count, f.visibility, f.download_count, COALESCE(f.tags, '{}')`
+    sorts, defaultSort := fileSorts(), "date"
+    q := c.Query("q")
+    if q != "" {
+        tsquery := fmt.Sprintf("websearch_to_tsquery('%s', %s)", extract.Config, query.arg(q))
+        rank := fmt.Sprintf("COALESCE((SELECT ts_rank(t.tsv, %s) FROM blob_text t WHERE t.hash = f.hash), 0)", tsquery)
+        columns += fmt.Sprintf(`, %s,
+             (SELECT ts_headline('%s', t.body, %s, %s) FROM blob_text t WHERE t.hash = f.hash)`,
+            rank, extract.Config, tsquery, query.arg(snippetOptions))
+        sorts["relevance"] = sortKey{rank, "real"}
+        defaultSort = "relevance"
+    }
+
+    p, ok := parsePage(c, sorts, defaultSort)
+    if !ok {
+        return
+    }
+
+    // Facets count every match, not just this page; clients paging on can
+    // skip them
+    var facets map[string][]FacetBucket
+    if c.Query("facets") != "false" {
+        var err error
+        if facets, err = searchFacets(c.Request.Context(), query); err != nil {
+            log.Printf("Failed to compute facets: %v", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute facets"})
+            return
+        }
+    }
+
+    rows, total, err := query.run(c.Request.Context(), columns, p)
+    if err != nil {
+        log.Printf("Failed to search files: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search files"})
+        return
+    }
+    defer rows.Close()
+
+    results := []map[string]interface{}{}
+    for rows.Next() {
+        if p.done() {
+            break
+        }
+        var id, refCount, dCount int
+        var filename, mimeType, hash, vis string
+        var size int64
+        var uploadDate time.Time
+        var tags []string
+        var rank float32
+        var snippet *string
+
+        dest := []interface{}{&id, &filename, &mimeType, &size, &hash, &uploadDate, &refCount, &vis, &dCount, &tags}
+        if q != "" {
+            dest = append(dest, &rank, &snippet)
+        }
+        if err := p.scan(rows, dest...); err != nil {
+            log.Printf("Failed to search files: %v", err)
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search files"})
+            return
+        }
+
+        result := map[string]interface{}{
+            "id":             id,
+            "filename":       filename,
+            "mime_type":      mimeType,
+            "size":           size,
+            "hash":           hash,
+            "uploadDate":     uploadDate,
+            "ref_count":      refCount,
+            "visibility":     vis,
+            "download_count": dCount,
+            "tags":           tags,
+        }
+        if q != "" {
+            result["rank"] = rank
+            result["snippet"] = highlight(snippet)
+        }
+        results = append(results, result)
+    }
+
+    c.JSON(http.StatusOK, SearchPage{Page: p.response(results, total), Facets: facets})
+}
+
+// searchFilters adds the search query parameters to a query as conditions
+// on files, responding 400 and returning false when ?query= does not parse.
+// Shared by SearchFiles and DownloadArchive so both select the same files.
+func searchFilters(c *gin.Context, query *listQuery) bool {
     // Query params
     filename := c.Query("filename")
     mime := c.Query("mime")
@@ -28,46 +137,32 @@ func SearchFiles(c *gin.Context) {
     startDate := c.Query("startDate")
     endDate := c.Query("endDate")
     tags := c.QueryArray("tags")
-
-    base := `SELECT id, filename, mime_type, size, hash, upload_date, ref_count, visibility, download_count
-             FROM files WHERE user_id=$1`
-    args := []interface{}{userID}
-    conditions := []string{}
-    i := 2
+    visibility := c.Query("visibility")
+    q := c.Query("q")
 
     if filename != "" {
-        conditions = append(conditions, fmt.Sprintf("filename ILIKE $%d", i))
-        args = append(args, "%"+filename+"%")
-        i++
+        query.and("filename ILIKE " + query.arg("%"+filename+"%"))
     }
 
     if mime != "" {
-        conditions = append(conditions, fmt.Sprintf("mime_type ILIKE $%d", i))
-        args = append(args, "%"+mime+"%")
-        i++
+        query.and("mime_type ILIKE " + query.arg("%"+mime+"%"))
     }
 
     if minSize != "" {
         if minVal, err := strconv.ParseInt(minSize, 10, 64); err == nil {
-            conditions = append(conditions, fmt.Sprintf("size >= $%d", i))
-            args = append(args, minVal)
-            i++
+            query.and("size >= " + query.arg(minVal))
         }
     }
 
     if maxSize != "" {
         if maxVal, err := strconv.ParseInt(maxSize, 10, 64); err == nil {
-            conditions = append(conditions, fmt.Sprintf("size <= $%d", i))
-            args = append(args, maxVal)
-            i++
+            query.and("size <= " + query.arg(maxVal))
         }
     }
 
     if startDate != "" {
         if t, err := time.Parse("2006-01-02", startDate); err == nil {
-            conditions = append(conditions, fmt.Sprintf("upload_date >= $%d", i))
-            args = append(args, t)
-            i++
+            query.and("upload_date >= " + query.arg(t))
         }
     }
 
@@ -75,57 +170,51 @@ func SearchFiles(c *gin.Context) {
         if t, err := time.Parse("2006-01-02", endDate); err == nil {
             // Add +1 day so it's inclusive
             t = t.Add(24 * time.Hour)
-            conditions = append(conditions, fmt.Sprintf("upload_date < $%d", i))
-            args = append(args, t)
-            i++
+            query.and("upload_date < " + query.arg(t))
         }
     }
 
-    if len(tags) > 0 {
-        conditions = append(conditions, fmt.Sprintf("tags && $%d", i))
-        args = append(args, pq.Array(tags))
-        i++
+    if visibility != "" {
+        query.and("COALESCE(visibility, 'private') = " + query.arg(visibility))
     }
 
-    if len(conditions) > 0 {
-        base += " AND " + strings.Join(conditions, " AND ")
+    // Document text, matched like a web search: words, "phrases", -excluded
+    if q != "" {
+        query.and(fmt.Sprintf(
+            "hash IN (SELECT hash FROM blob_text WHERE tsv @@ websearch_to_tsquery('%s', %s))", extract.Config, query.arg(q)))
     }
 
-    fmt.Println("🔍 Executing:", base, args)
-
-    rows, err := db.DB.Query(c.Request.Context(), base, args...)
-    if err != nil {
-        fmt.Println("Query error:", err)
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
+    // Stored tags are normalised; anything that cannot be a tag matches nothing
+    if len(tags) > 0 {
+        if normalized, err := splitTags(tags...); err == nil {
+            tags = normalized
+        }
+        query.and("tags && " + query.arg(pq.Array(tags)))
     }
-    defer rows.Close()
 
-    var results []map[string]interface{}
-    for rows.Next() {
-        var id, refCount, dCount int
-        var filename, mimeType, hash, vis string
-        var size int64
-        var uploadDate time.Time
-
-        if err := rows.Scan(&id, &filename, &mimeType, &size, &hash, &uploadDate, &refCount, &vis, &dCount); err != nil {
-            fmt.Println("Scan error:", err)
-            c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-            return
+    // The query language, for what the parameters above cannot say: OR,
+    // negation and grouping, e.g. tag:invoice -tag:paid size>1MB. Repeated
+    // queries must all match.
+    for _, expr := range c.QueryArray("query") {
+        if expr == "" {
+            continue
         }
-
-        results = append(results, map[string]interface{}{
-            "id":             id,
-            "filename":       filename,
-            "mime_type":      mimeType,
-            "size":           size,
-            "hash":           hash,
-            "uploadDate":     uploadDate,
-            "ref_count":      refCount,
-            "visibility":     vis,
-            "download_count": dCount,
-        })
+        cond, err := searchql.Compile(expr, query.arg)
+        if err != nil {
+            c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+            return false
+        }
+        query.and(cond)
     }
+    return true
+}
 
-    c.JSON(http.StatusOK, gin.H{"results": results})
+// highlight escapes a snippet for HTML and marks its matches with <mark>.
+func highlight(snippet *string) string {
+    if snippet == nil {
+        return ""
+    }
+    s := html.EscapeString(*snippet)
+    s = strings.ReplaceAll(s, snippetStart, "<mark>")
+    return strings.ReplaceAll(s, snippetStop, "</mark>")
 }
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Share links give anyone holding the URL access to one file, without
+// making it public. The token is 32 random bytes, so links cannot be
+// guessed the way /public/:id can.
+
+const (
+	defaultLinkLifetime = 7 * 24 * time.Hour
+	maxLinkLifetime     = 365 * 24 * time.Hour
+)
+
+type ShareLink struct {
+	ID            int        `json:"id"`
+	Token         string     `json:"token"`
+	URL           string     `json:"url"`
+	FileID        int        `json:"file_id"`
+	HasPassword   bool       `json:"has_password"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	MaxDownloads  *int       `json:"max_downloads"`
+	DownloadCount int        `json:"download_count"`
+	RevokedAt     *time.Time `json:"revoked_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type createLinkRequest struct {
+	ExpiresIn    int64      `json:"expires_in"` // seconds from now
+	ExpiresAt    *time.Time `json:"expires_at"`
+	Password     string     `json:"password"`
+	MaxDownloads *int       `json:"max_downloads"`
+}
+
+// CreateShareLink creates a link to one of the user's files.
+func CreateShareLink(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	var req createLinkRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(defaultLinkLifetime)
+	switch {
+	case req.ExpiresAt != nil:
+		expiresAt = *req.ExpiresAt
+	case req.ExpiresIn > 0:
+		expiresAt = time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+	}
+	if !expiresAt.After(time.Now()) || expiresAt.After(time.Now().Add(maxLinkLifetime)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future and within a year"})
+		return
+	}
+	if req.MaxDownloads != nil && *req.MaxDownloads < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_downloads must be at least 1"})
+		return
+	}
+
+	var passwordHash *string
+	if req.Password != "" {
+		hash, err := utils.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create link"})
+			return
+		}
+		passwordHash = &hash
+	}
+
+	var raw [32]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create link"})
+		return
+	}
+	link := ShareLink{
+		Token:        base64.RawURLEncoding.EncodeToString(raw[:]),
+		FileID:       f.ID,
+		HasPassword:  passwordHash != nil,
+		ExpiresAt:    expiresAt.UTC(),
+		MaxDownloads: req.MaxDownloads,
+	}
+	err = db.DB.QueryRow(c, `
+		INSERT INTO share_links (token, file_id, created_by, password_hash, expires_at, max_downloads)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		link.Token, f.ID, userID, passwordHash, link.ExpiresAt, link.MaxDownloads,
+	).Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create link"})
+		return
+	}
+	link.URL = "/s/" + link.Token
+
+	c.JSON(http.StatusCreated, link)
+}
+
+// ListShareLinks lists every link to one of the user's files, including
+// expired and revoked ones.
+func ListShareLinks(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	rows, err := db.DB.Query(c, `
+		SELECT id, token, file_id, password_hash IS NOT NULL, expires_at, max_downloads, download_count, revoked_at, created_at
+		FROM share_links WHERE file_id=$1
+		ORDER BY created_at DESC`, f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch links"})
+		return
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var l ShareLink
+		if err := rows.Scan(&l.ID, &l.Token, &l.FileID, &l.HasPassword, &l.ExpiresAt, &l.MaxDownloads,
+			&l.DownloadCount, &l.RevokedAt, &l.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan link data"})
+			return
+		}
+		l.URL = "/s/" + l.Token
+		links = append(links, l)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"links": links})
+}
+
+// RevokeShareLink stops a link from working. The row is kept so the owner
+// can still see its download count.
+func RevokeShareLink(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+
+	var fileID string
+	err := db.DB.QueryRow(c, "SELECT file_id::text FROM share_links WHERE id=$1", c.Param("id")).Scan(&fileID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke link"})
+		return
+	}
+	if _, err := authorizeFile(c, fileID, userID, accessManage); err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	_, err = db.DB.Exec(c,
+		"UPDATE share_links SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE id=$1", c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+// SharedLinkFile serves the file behind a share link. A password, when the
+// link has one, is sent in the X-Share-Password header, never in the URL,
+// where it would end up in logs and browser history. On a link with a
+// download limit every request that transfers content uses up one
+// download, Range requests included, since any set of ranges can add up
+// to the whole file; on other links only downloads from the start count.
+func SharedLinkFile(c *gin.Context) {
+	var linkID, fileID int
+	var passwordHash *string
+	var expiresAt time.Time
+	var maxDownloads *int
+	var revokedAt *time.Time
+	var filename, mimeType, hash string
+	err := db.DB.QueryRow(c, `
+		SELECT l.id, l.password_hash, l.expires_at, l.max_downloads, l.revoked_at,
+		       f.id, f.filename, f.mime_type, f.hash
+		FROM share_links l
+		JOIN files f ON f.id = l.file_id
+		WHERE l.token=$1 AND f.deleted_at IS NULL`, c.Param("token"),
+	).Scan(&linkID, &passwordHash, &expiresAt, &maxDownloads, &revokedAt, &fileID, &filename, &mimeType, &hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Link not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load link"})
+		return
+	}
+
+	if revokedAt != nil || time.Now().After(expiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "This link has expired or been revoked"})
+		return
+	}
+	if passwordHash != nil {
+		password := c.GetHeader("X-Share-Password")
+		if password == "" || !utils.CheckPassword(*passwordHash, password) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "A valid password is required for this link"})
+			return
+		}
+	}
+
+	counts := countsAsDownload(c, hash)
+	if counts || (maxDownloads != nil && transfersContent(c, hash)) {
+		// Claim a download atomically so concurrent requests cannot
+		// exceed the cap
+		tag, err := db.DB.Exec(c, `
+			UPDATE share_links SET download_count = download_count + 1
+			WHERE id=$1 AND (max_downloads IS NULL OR download_count < max_downloads)`, linkID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load link"})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			c.JSON(http.StatusGone, gin.H{"error": "This link has reached its download limit"})
+			return
+		}
+	}
+	if counts {
+		if _, err := db.DB.Exec(c, "UPDATE files SET download_count = download_count + 1 WHERE id=$1", fileID); err != nil {
+			log.Printf("Failed to update download count for link %d: %v", linkID, err)
+		}
+	}
+
+	serveBlob(c, hash, filename, mimeType, true)
+}
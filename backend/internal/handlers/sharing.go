@@ -24,10 +24,20 @@ func UpdateVisibility(c *gin.Context) {
 		return
 	}
 
-	// Only owner can change
-	_, err := db.DB.Exec(c,
-		"UPDATE files SET visibility=$1 WHERE id=$2 AND user_id=$3",
-		newVisibility.Visibility, fileID, userID,
+	if newVisibility.Visibility != "public" && newVisibility.Visibility != "private" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Visibility must be public or private"})
+		return
+	}
+
+	// Only the owner and co-owners can change
+	f, err := authorizeFile(c, fileID, userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	_, err = db.DB.Exec(c,
+		"UPDATE files SET visibility=$1 WHERE id=$2",
+		newVisibility.Visibility, f.ID,
 	)
 
 	if err != nil {
@@ -41,21 +51,24 @@ func UpdateVisibility(c *gin.Context) {
 func PublicFile(c *gin.Context) {
 	fileID := c.Param("id")
 
-	var filename, path, visibility string
+	var filename, mimeType, hash, visibility string
 	err := db.DB.QueryRow(c,
-		"SELECT filename, path, visibility FROM files WHERE id=$1", fileID,
-	).Scan(&filename, &path, &visibility)
+		"SELECT filename, mime_type, hash, visibility FROM files WHERE id=$1 AND deleted_at IS NULL", fileID,
+	).Scan(&filename, &mimeType, &hash, &visibility)
 
 	if err != nil || visibility != "public" {
 		c.JSON(http.StatusForbidden, gin.H{"error": "File not public"})
 		return
 	}
-	_, err = db.DB.Exec(c, "UPDATE files SET download_count = download_count + 1 WHERE id=$1", fileID)
-	if err != nil {
-		log.Printf("Failed to update download count for file %s: %v", fileID, err)
-		return
+	// Range requests after the first and cache revalidations are not new
+	// downloads
+	if countsAsDownload(c, hash) {
+		_, err = db.DB.Exec(c, "UPDATE files SET download_count = download_count + 1 WHERE id=$1", fileID)
+		if err != nil {
+			log.Printf("Failed to update download count for file %s: %v", fileID, err)
+		}
 	}
-	c.FileAttachment(path, filename)
+	serveBlob(c, hash, filename, mimeType, true)
 }
 
 type PublicFileInfo struct {
@@ -68,25 +81,24 @@ type PublicFileInfo struct {
 }
 
 func ListPublicFiles(c *gin.Context) {
+	p, ok := parsePage(c, fileSorts(), "date")
+	if !ok {
+		return
+	}
+
+	query := newListQuery(`
+			files f
+		INNER JOIN
+			users u ON f.user_id = u.id`, `
+			f.visibility = 'public' AND f.deleted_at IS NULL`)
 
-	query := `
-		SELECT
+	rows, total, err := query.run(c, `
 			f.id,
 			u.username,
 			f.filename,
 			f.size,
 			f.mime_type,
-			f.upload_date
-		FROM
-			files f
-		INNER JOIN
-			users u ON f.user_id = u.id
-		WHERE
-			f.visibility = 'public'
-		ORDER BY
-			f.upload_date DESC;`
-
-	rows, err := db.DB.Query(c, query)
+			f.upload_date`, p)
 	if err != nil {
 		log.Printf("Database query error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not fetch public files"})
@@ -94,11 +106,14 @@ func ListPublicFiles(c *gin.Context) {
 	}
 	defer rows.Close()
 
-	var files []PublicFileInfo
+	files := []PublicFileInfo{}
 
 	for rows.Next() {
+		if p.done() {
+			break
+		}
 		var file PublicFileInfo
-		if err := rows.Scan(&file.Fileid, &file.Username, &file.Filename, &file.Size, &file.MimeType, &file.UploadDate); err != nil {
+		if err := p.scan(rows, &file.Fileid, &file.Username, &file.Filename, &file.Size, &file.MimeType, &file.UploadDate); err != nil {
 			log.Printf("Error scanning row: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error processing file data"})
 			return
@@ -113,23 +128,22 @@ func ListPublicFiles(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, files)
+	c.JSON(http.StatusOK, p.response(files, total))
 }
 
 func PublicFilePreview(c *gin.Context) {
     fileID := c.Param("id")
 
     // Query file info
-    var filename, mimeType, filepath string
-    err := db.DB.QueryRow(c, "SELECT filename, mime_type, path FROM files WHERE id=$1", fileID).
-        Scan(&filename, &mimeType, &filepath)
-    if err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+    var filename, mimeType, hash, visibility string
+    err := db.DB.QueryRow(c, "SELECT filename, mime_type, hash, visibility FROM files WHERE id=$1 AND deleted_at IS NULL", fileID).
+        Scan(&filename, &mimeType, &hash, &visibility)
+    if err != nil || visibility != "public" {
+        c.JSON(http.StatusForbidden, gin.H{"error": "File not public"})
         return
     }
 
-    // Set Content-Type to allow browser to preview
-    c.Header("Content-Type", mimeType)
-    c.File(filepath)
+    // Serve inline with the stored Content-Type so the browser can preview
+    serveBlob(c, hash, filename, mimeType, false)
 }
 
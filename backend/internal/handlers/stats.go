@@ -4,7 +4,6 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
 )
 
 func StorageStats(c *gin.Context) {
@@ -14,25 +13,25 @@ func StorageStats(c *gin.Context) {
         return
     }
 
-	var total int64
-	var original int64
-
-	// Deduplicated usage
-	db.DB.QueryRow(c, "SELECT COALESCE(SUM(size),0) FROM files WHERE user_id=$1", userID).Scan(&total)
-
-	// Original usage (without dedup) – count all references
-	db.DB.QueryRow(c, "SELECT COALESCE(SUM(size*ref_count),0) FROM files WHERE user_id=$1", userID).Scan(&original)
+	original, usage, err := personalStorage(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to measure storage"})
+		return
+	}
 
-	savings := original - total
+	// Deduplication: what the files add up to vs their distinct content
+	savings := original - usage.Content
 	var percent float64
 	if original > 0 {
 		percent = float64(savings) / float64(original) * 100
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"total_used": total,
-		"original":   original,
-		"savings":    savings,
-		"percent":    percent,
+		"total_used":          usage.Stored,
+		"original":            original,
+		"savings":             savings,
+		"percent":             percent,
+		"compression_savings": usage.CompressionSavings,
+		"encryption_overhead": usage.EncryptionOverhead,
 	})
 }
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Tags are stored normalised, so "Tax  Return" and "tax return" are the
+// same tag: lower case, with runs of whitespace collapsed to one space and
+// trimmed. A file's tags are kept sorted and without duplicates.
+
+const (
+	maxTagLength   = 50
+	maxTagsPerFile = 20
+)
+
+var errTooManyTags = fmt.Errorf("a file can have at most %d tags", maxTagsPerFile)
+
+// normalizeTag returns the stored form of a tag, or an error saying why it
+// is not acceptable.
+func normalizeTag(raw string) (string, error) {
+	tag := strings.ToLower(strings.Join(strings.Fields(raw), " "))
+	if tag == "" {
+		return "", errors.New("tags cannot be empty")
+	}
+	if utf8.RuneCountInString(tag) > maxTagLength {
+		return "", fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+	}
+	for _, r := range tag {
+		if r == ',' || unicode.IsControl(r) {
+			return "", fmt.Errorf("tag %q contains an invalid character", tag)
+		}
+	}
+	return tag, nil
+}
+
+// normalizeTags normalises a list of tags, dropping duplicates.
+func normalizeTags(raw []string) ([]string, error) {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, r := range raw {
+		tag, err := normalizeTag(r)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// splitTags normalises comma separated tag lists, as given in query
+// parameters and form fields.
+func splitTags(values ...string) ([]string, error) {
+	var raw []string
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.TrimSpace(t) != "" {
+				raw = append(raw, t)
+			}
+		}
+	}
+	return normalizeTags(raw)
+}
+
+// updateTags changes a file's tags to what change makes of the current
+// ones, which must stay within maxTagsPerFile.
+func updateTags(ctx context.Context, fileID int, change func([]string) []string) ([]string, error) {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var current []string
+	err = tx.QueryRow(ctx, "SELECT COALESCE(tags, '{}') FROM files WHERE id=$1 FOR UPDATE", fileID).Scan(&current)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := normalizeTags(change(current))
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > maxTagsPerFile {
+		return nil, errTooManyTags
+	}
+	if _, err := tx.Exec(ctx, "UPDATE files SET tags=$1 WHERE id=$2", tags, fileID); err != nil {
+		return nil, err
+	}
+	return tags, tx.Commit(ctx)
+}
+
+// addTags adds tags to a file's existing ones.
+func addTags(ctx context.Context, fileID int, tags []string) ([]string, error) {
+	return updateTags(ctx, fileID, func(current []string) []string {
+		return append(current, tags...)
+	})
+}
+
+// editFileTags is the common part of the per-file tag endpoints: the
+// caller must be able to edit the file, and the body holds the tags.
+func editFileTags(c *gin.Context, change func(current, tags []string) []string) {
+	userID, _ := c.Get("user_id")
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Tags == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Body must be {\"tags\": [...]}"})
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessWrite)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	result, err := updateTags(c, f.ID, func(current []string) []string { return change(current, tags) })
+	if errors.Is(err, errTooManyTags) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": f.ID, "tags": result})
+}
+
+// SetTags replaces a file's tags.
+func SetTags(c *gin.Context) {
+	editFileTags(c, func(_, tags []string) []string { return tags })
+}
+
+// AddTags adds tags to a file.
+func AddTags(c *gin.Context) {
+	editFileTags(c, func(current, tags []string) []string { return append(current, tags...) })
+}
+
+// RemoveTag removes one tag from a file.
+func RemoveTag(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	tag, err := normalizeTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessWrite)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	result, err := updateTags(c, f.ID, func(current []string) []string {
+		kept := []string{}
+		for _, t := range current {
+			if t != tag {
+				kept = append(kept, t)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": f.ID, "tags": result})
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// ListTags lists the tags used on the user's files, or with ?group_id= a
+// group's, with how many files have each.
+func ListTags(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	scope, args, ok := fileScope(c, userID)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DB.Query(c, `
+		SELECT t, COUNT(*) FROM files, unnest(tags) AS t
+		WHERE `+scope+`
+		GROUP BY t
+		ORDER BY COUNT(*) DESC, t`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tags"})
+		return
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan tag data"})
+			return
+		}
+		tags = append(tags, t)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+// RenameTag renames a tag on all of the user's files, or with ?group_id=
+// on a group's. Renaming to a tag that already exists merges the two.
+// Files in the trash are included so they match when restored.
+func RenameTag(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	var req struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Body must be {\"from\": ..., \"to\": ...}"})
+		return
+	}
+	from, err := normalizeTag(req.From)
+	if err == nil {
+		req.To, err = normalizeTag(req.To)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	scope, args := "user_id=$1 AND group_id IS NULL", []interface{}{userID}
+	if raw := c.Query("group_id"); raw != "" {
+		groupID, ok := requireGroupRole(c, raw, userID, groupMember, groupAdmin)
+		if !ok {
+			return
+		}
+		scope, args = "group_id=$1", []interface{}{groupID}
+	}
+
+	// array_replace can leave the new tag twice when merging
+	tag, err := db.DB.Exec(c, `
+		UPDATE files SET tags = ARRAY(SELECT DISTINCT t FROM unnest(array_replace(tags, $2, $3)) AS t ORDER BY t)
+		WHERE `+scope+` AND $2 = ANY(tags)`, append(args, from, req.To)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename tag"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": req.To, "files": tag.RowsAffected()})
+}
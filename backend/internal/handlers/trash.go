@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+)
+
+// Deleted files go to the trash first. They keep their quota charge and
+// blob until they are purged, by emptying the trash or by the background
+// purger once they are older than the retention period.
+
+// trashPurgeInterval is how often the purger looks for expired files.
+const trashPurgeInterval = time.Hour
+
+// trashRetention is how long files stay in the trash, from
+// TRASH_RETENTION_DAYS (default 30).
+func trashRetention() time.Duration {
+	days := 30
+	if n, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS")); err == nil && n >= 0 {
+		days = n
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// StartTrashPurge permanently deletes expired trash in the background.
+func StartTrashPurge(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := purgeTrash(ctx, "deleted_at < $1", time.Now().Add(-trashRetention()))
+				if err != nil {
+					log.Printf("trash: purge failed: %v", err)
+				} else if n > 0 {
+					log.Printf("trash: purged %d files", n)
+				}
+			}
+		}
+	}()
+}
+
+// purgeTrash permanently deletes the trashed files matching cond, giving
+// their quota back and releasing their blobs.
+func purgeTrash(ctx context.Context, cond string, args ...interface{}) (int, error) {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Locked so a concurrent restore either wins or waits
+	rows, err := tx.Query(ctx, `
+		SELECT id, user_id, group_id FROM files
+		WHERE deleted_at IS NOT NULL AND `+cond+` FOR UPDATE`, args...)
+	if err != nil {
+		return 0, err
+	}
+	var files []*fileRecord
+	for rows.Next() {
+		var f fileRecord
+		if err := rows.Scan(&f.ID, &f.OwnerID, &f.GroupID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		files = append(files, &f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var orphans []string
+	for _, f := range files {
+		refs, err := removeFile(ctx, tx, f)
+		if err != nil {
+			return 0, err
+		}
+		orphans = append(orphans, refs...)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	blobs.Remove(ctx, orphans)
+	return len(files), nil
+}
+
+type TrashItem struct {
+	ID        int       `json:"id"`
+	Filename  string    `json:"filename"`
+	MimeType  string    `json:"mime_type"`
+	Size      int64     `json:"size"`
+	FolderID  *int      `json:"folder_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy *string   `json:"deleted_by"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+// ListTrash lists the user's trashed files, or with ?group_id= a group's.
+func ListTrash(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	scope, args, ok := spaceScope(c, userID)
+	if !ok {
+		return
+	}
+
+	rows, err := db.DB.Query(c, `
+		SELECT f.id, f.filename, f.mime_type, f.size, f.folder_id, f.deleted_at, u.username
+		FROM files f
+		LEFT JOIN users u ON u.id = f.deleted_by
+		WHERE `+scope+` AND f.deleted_at IS NOT NULL
+		ORDER BY f.deleted_at DESC`, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch trash"})
+		return
+	}
+	defer rows.Close()
+
+	retention := trashRetention()
+	items := []TrashItem{}
+	for rows.Next() {
+		var t TrashItem
+		if err := rows.Scan(&t.ID, &t.Filename, &t.MimeType, &t.Size, &t.FolderID, &t.DeletedAt, &t.DeletedBy); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan trash data"})
+			return
+		}
+		t.PurgeAt = t.DeletedAt.Add(retention)
+		items = append(items, t)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"files": items})
+}
+
+// RestoreFile takes a file out of the trash, back into its folder if that
+// still exists.
+func RestoreFile(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	f, err := authorizeTrashed(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	tag, err := db.DB.Exec(c,
+		"UPDATE files SET deleted_at=NULL, deleted_by=NULL WHERE id=$1 AND deleted_at IS NOT NULL", f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore file"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "restored", "id": f.ID, "folder_id": f.FolderID})
+}
+
+// PurgeFile permanently deletes one file from the trash.
+func PurgeFile(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	f, err := authorizeTrashed(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	n, err := purgeTrash(c, "id=$1", f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+		return
+	}
+	if n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "file deleted"})
+}
+
+// EmptyTrash permanently deletes everything in the user's trash, or with
+// ?group_id= in a group's, which only its admins may do.
+func EmptyTrash(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	cond, arg := "user_id=$1 AND group_id IS NULL", userID
+	if raw := c.Query("group_id"); raw != "" {
+		groupID, ok := requireGroupRole(c, raw, userID, groupAdmin)
+		if !ok {
+			return
+		}
+		cond, arg = "group_id=$1", groupID
+	}
+
+	n, err := purgeTrash(c, cond, arg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to empty trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "trash emptied", "deleted": n})
+}
@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Resumable uploads following the tus 1.0 protocol (core, creation and
+// termination extensions). Partial data is kept in the staging directory
+// and the SHA-256 state is saved with the session after every PATCH, so a
+// finished upload is never read back to hash it.
+
+const tusVersion = "1.0.0"
+
+// tusLock serialises PATCH and DELETE requests for an upload across every
+// server instance with an advisory lock on the session. The lock is held
+// on its own pooled connection, since finishing an upload runs in
+// transactions of its own, and is released with it.
+func tusLock(ctx context.Context, id string) (func(), error) {
+	conn, err := db.DB.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := "uploads:" + id
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock(hashtext($1))", key); err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return func() {
+		// A connection that cannot unlock is closed, which drops the lock
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", key); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+	}, nil
+}
+
+func tusPath(id string) string {
+	return filepath.Join(storage.StagingDir, "tus-"+id)
+}
+
+// tusCheckVersion rejects requests for a protocol version we do not speak.
+func tusCheckVersion(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// TusOptions advertises the supported protocol version and extensions.
+func TusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,termination")
+	if max := maxUploadSize(); max > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(max, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// CreateUpload starts a new upload session (tus creation extension).
+func CreateUpload(c *gin.Context) {
+	if !tusCheckVersion(c) {
+		return
+	}
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid Upload-Length"})
+		return
+	}
+	if max := maxUploadSize(); max > 0 && length > max {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Upload exceeds maximum size"})
+		return
+	}
+
+	meta := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	target, ok := resolveUploadTarget(c, userID, func(key string) string { return meta[key] })
+	if !ok {
+		return
+	}
+
+	quota, err := target.quota(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve user quota"})
+		return
+	}
+	if length > quota {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Upload size exceeds available storage quota", "quota": quota})
+		return
+	}
+
+	filename := filepath.Base(meta["filename"])
+	if filename == "." || filename == "/" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Metadata must include a filename"})
+		return
+	}
+	mimeType := meta["filetype"]
+
+	var versionOf *int
+	if target.VersionOf != nil {
+		versionOf = &target.VersionOf.ID
+	}
+
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	id := hex.EncodeToString(raw[:])
+
+	f, err := os.Create(tusPath(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	f.Close()
+
+	_, err = db.DB.Exec(c, `
+		INSERT INTO upload_sessions (id, user_id, group_id, folder_id, version_of, filename, mime_type, length, tags)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		id, userID, target.GroupID, target.FolderID, versionOf, filename, mimeType, length, target.Tags)
+	if err != nil {
+		os.Remove(tusPath(id))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	// Zero byte uploads are complete as soon as they exist
+	if length == 0 {
+		saved, err := finishUpload(c, id, target, filename, mimeType, 0, sha256.New())
+		if errors.Is(err, errQuotaExceeded) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Upload size exceeds available storage quota"})
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to finish upload %s: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+			return
+		}
+		if fileID, ok := saved["id"].(int); ok {
+			c.Header("Content-Location", "/api/files/"+strconv.Itoa(fileID)+"/download")
+		}
+	}
+
+	c.Header("Location", "/api/uploads/"+id)
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+type uploadSession struct {
+	groupID   *int
+	folderID  *int
+	versionOf *int
+	filename  string
+	mimeType  string
+	length    int64
+	offset    int64
+	hashState []byte
+	tags      []string
+}
+
+func loadUpload(c *gin.Context, id string, userID interface{}) (*uploadSession, bool) {
+	var s uploadSession
+	err := db.DB.QueryRow(c, `
+		SELECT group_id, folder_id, version_of, filename, mime_type, length, upload_offset, hash_state, tags
+		FROM upload_sessions WHERE id=$1 AND user_id=$2`,
+		id, userID,
+	).Scan(&s.groupID, &s.folderID, &s.versionOf, &s.filename, &s.mimeType, &s.length, &s.offset, &s.hashState, &s.tags)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload"})
+		return nil, false
+	}
+	return &s, true
+}
+
+// UploadOffset reports how much of an upload the server has (tus HEAD).
+func UploadOffset(c *gin.Context) {
+	if !tusCheckVersion(c) {
+		return
+	}
+	userID, _ := c.Get("user_id")
+	s, ok := loadUpload(c, c.Param("id"), userID)
+	if !ok {
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(s.offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(s.length, 10))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+}
+
+// AppendUpload writes a chunk at the current offset (tus PATCH). Whatever
+// arrives before a dropped connection is kept so the client can resume.
+func AppendUpload(c *gin.Context) {
+	if !tusCheckVersion(c) {
+		return
+	}
+	userID, _ := c.Get("user_id")
+	id := c.Param("id")
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid Upload-Offset"})
+		return
+	}
+
+	unlock, err := tusLock(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock upload"})
+		return
+	}
+	defer unlock()
+
+	s, ok := loadUpload(c, id, userID)
+	if !ok {
+		return
+	}
+	if offset != s.offset {
+		c.AbortWithStatus(http.StatusConflict)
+		return
+	}
+
+	h := sha256.New()
+	if s.hashState != nil {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.hashState); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Corrupt upload state"})
+			return
+		}
+	}
+
+	f, err := os.OpenFile(tusPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open upload"})
+		return
+	}
+	// Drop anything past the recorded offset left by an interrupted write
+	err = f.Truncate(s.offset)
+	if err == nil {
+		_, err = f.Seek(s.offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open upload"})
+		return
+	}
+
+	n, copyErr := io.Copy(io.MultiWriter(f, h), io.LimitReader(c.Request.Body, s.length-s.offset))
+	if err := f.Close(); copyErr == nil {
+		copyErr = err
+	}
+	s.offset += n
+
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err == nil {
+		_, err = db.DB.Exec(c, `
+			UPDATE upload_sessions SET upload_offset=$1, hash_state=$2, updated_at=CURRENT_TIMESTAMP
+			WHERE id=$3`,
+			s.offset, state, id)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save upload progress"})
+		return
+	}
+	if copyErr != nil {
+		log.Printf("Upload %s interrupted at offset %d: %v", id, s.offset, copyErr)
+		c.Header("Upload-Offset", strconv.FormatInt(s.offset, 10))
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(s.offset, 10))
+	if s.offset < s.length {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	target := uploadTarget{UserID: userID, GroupID: s.groupID, FolderID: s.folderID, Tags: s.tags}
+	if s.versionOf != nil {
+		// The user may have lost access to the file since starting
+		f, err := authorizeFile(c, strconv.Itoa(*s.versionOf), userID, accessWrite)
+		if err != nil {
+			abortFileError(c, err)
+			return
+		}
+		target = uploadTarget{UserID: f.OwnerID, GroupID: f.GroupID, FolderID: f.FolderID, VersionOf: f, Tags: s.tags}
+	}
+	saved, err := finishUpload(c, id, target, s.filename, s.mimeType, s.length, h)
+	if errors.Is(err, errQuotaExceeded) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Upload size exceeds available storage quota"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to finish upload %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	// tus answers every PATCH with 204, so the new file is only named in
+	// Location
+	if id, ok := saved["id"].(int); ok {
+		c.Header("Location", "/api/files/"+strconv.Itoa(id)+"/download")
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// finishUpload hands a complete upload to the same dedup, quota and files
+// logic as UploadFile and removes the session.
+// The session and its data are kept if that fails for any reason other
+// than quota, so the client can retry the final PATCH.
+func finishUpload(c *gin.Context, id string, target uploadTarget, filename, mimeType string, size int64, h hash.Hash) (gin.H, error) {
+	blob, err := storage.OpenTempBlob(tusPath(id), hex.EncodeToString(h.Sum(nil)), size)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	saved, _, err := ingestFile(c, target, filename, mimeType, blob)
+	if err != nil && !errors.Is(err, errQuotaExceeded) {
+		return nil, err
+	}
+	if _, err := db.DB.Exec(c, "DELETE FROM upload_sessions WHERE id=$1", id); err != nil {
+		log.Printf("Failed to remove upload session %s: %v", id, err)
+	}
+	os.Remove(tusPath(id))
+	return saved, err
+}
+
+// TerminateUpload abandons an upload (tus termination extension).
+func TerminateUpload(c *gin.Context) {
+	if !tusCheckVersion(c) {
+		return
+	}
+	userID, _ := c.Get("user_id")
+	id := c.Param("id")
+
+	unlock, err := tusLock(c.Request.Context(), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock upload"})
+		return
+	}
+	defer unlock()
+
+	tag, err := db.DB.Exec(c, "DELETE FROM upload_sessions WHERE id=$1 AND user_id=$2", id, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete upload"})
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	os.Remove(tusPath(id))
+	c.Status(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs. "name" and "type" are accepted as aliases used
+// by some clients.
+func parseTusMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	if meta["filename"] == "" {
+		meta["filename"] = meta["name"]
+	}
+	if meta["filetype"] == "" {
+		meta["filetype"] = meta["type"]
+	}
+	return meta
+}
@@ -5,6 +5,7 @@ package handlers
 import (
 	"net/http"
 	"github.com/gin-gonic/gin"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
 	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
 )
 
@@ -23,14 +24,16 @@ func GetUserProfile(c *gin.Context) {
 		return
 	}
 
-	var totalUsed, originalSize int64
-	db.DB.QueryRow(c, "SELECT COALESCE(SUM(size),0) FROM files WHERE user_id=$1", userID).Scan(&totalUsed)
-	db.DB.QueryRow(c, "SELECT COALESCE(SUM(size*ref_count),0) FROM files WHERE user_id=$1", userID).Scan(&originalSize)
+	totalUsed, usage, err := personalStorage(c, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to measure storage"})
+		return
+	}
 
-	savings := originalSize - totalUsed
+	savings := totalUsed - usage.Content
 	var percentSaved float64
-	if originalSize > 0 {
-		percentSaved = float64(savings) / float64(originalSize) * 100
+	if totalUsed > 0 {
+		percentSaved = float64(savings) / float64(totalUsed) * 100
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -41,9 +44,28 @@ func GetUserProfile(c *gin.Context) {
 		"storage_stats": gin.H{
 			"total_used":   totalUsed,
 			"storage_quota":  storageQuota,
-			"original":     originalSize,
+			"original":     totalUsed,
+			"stored":       usage.Stored,
 			"savings":      savings,
 			"percent":      percentSaved,
+			"compression_savings": usage.CompressionSavings,
+			"encryption_overhead": usage.EncryptionOverhead,
 		},
 	})
-}
\ No newline at end of file
+}
+
+// personalStorage measures a user's own files, their versions and their
+// trash, everything charged to the user's quota: logical is what they
+// add up to, usage the blobs behind them with shared content counted once.
+func personalStorage(c *gin.Context, userID interface{}) (logical int64, usage blobs.Usage, err error) {
+	err = db.DB.QueryRow(c, `SELECT COALESCE(SUM(size*ref_count),0) + COALESCE((SELECT SUM(v.size) FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE f.user_id=$1 AND f.group_id IS NULL),0) FROM files WHERE user_id=$1 AND group_id IS NULL`, userID).Scan(&logical)
+	if err != nil {
+		return 0, blobs.Usage{}, err
+	}
+	usage, err = blobs.MeasureUsage(c, db.DB, `
+		SELECT hash FROM files WHERE user_id=$1 AND group_id IS NULL
+		UNION SELECT v.hash FROM file_versions v JOIN files f ON f.id = v.file_id
+		WHERE f.user_id=$1 AND f.group_id IS NULL`, userID)
+	return logical, usage, err
+}
@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// A file keeps the contents it replaced as numbered versions. Uploading
+// with ?version_of=, or uploading a file with the same name into the same
+// folder, makes a new version; restoring an old one makes its content
+// current again as another new version. Every version counts against the
+// quota that pays for the file, and the oldest are pruned once a file has
+// more than its retention.
+
+// errVersionUnchanged is returned by addVersion when the content is already
+// the file's current version.
+var errVersionUnchanged = errors.New("content matches current version")
+
+// defaultVersionRetention is how many earlier versions a file keeps unless
+// set on the file, from FILE_VERSION_RETENTION (default 10).
+func defaultVersionRetention() int {
+	if n, err := strconv.Atoi(os.Getenv("FILE_VERSION_RETENTION")); err == nil && n >= 0 {
+		return n
+	}
+	return 10
+}
+
+// chargeQuota takes size from whoever pays for f: its owner, or its group.
+func chargeQuota(ctx context.Context, tx pgx.Tx, f *fileRecord, size int64) error {
+	charge := "UPDATE users SET storage_quota = storage_quota - $1 WHERE id=$2 AND storage_quota >= $1"
+	var payer interface{} = f.OwnerID
+	if f.GroupID != nil {
+		charge = "UPDATE groups SET storage_quota = storage_quota - $1 WHERE id=$2 AND storage_quota >= $1"
+		payer = *f.GroupID
+	}
+	tag, err := tx.Exec(ctx, charge, size, payer)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = errQuotaExceeded
+	}
+	return err
+}
+
+// addVersion makes the content with the given hash the current version of
+// f, keeping what it replaces as the previous version. acquire takes the
+// blob reference for the new content inside the transaction.
+func addVersion(ctx context.Context, f *fileRecord, hash string, size int64, mimeType string, acquire func(pgx.Tx) error) (int, error) {
+	tx, err := db.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var curHash, curMime string
+	var curSize int64
+	var version int
+	var uploaded time.Time
+	var retention *int
+	err = tx.QueryRow(ctx, `
+		SELECT hash, size, mime_type, version, upload_date, version_retention
+		FROM files WHERE id=$1 FOR UPDATE`, f.ID,
+	).Scan(&curHash, &curSize, &curMime, &version, &uploaded, &retention)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errFileNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if curHash == hash {
+		return version, errVersionUnchanged
+	}
+
+	if err := chargeQuota(ctx, tx, f, size); err != nil {
+		return 0, err
+	}
+	if err := acquire(tx); err != nil {
+		return 0, err
+	}
+
+	// The files row's reference to the old content moves to its version
+	_, err = tx.Exec(ctx, `
+		INSERT INTO file_versions (file_id, version, hash, size, mime_type, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		f.ID, version, curHash, curSize, curMime, uploaded)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow(ctx, `
+		UPDATE files SET hash=$1, size=$2, mime_type=$3, version = version + 1, upload_date=CURRENT_TIMESTAMP
+		WHERE id=$4 RETURNING version`,
+		hash, size, mimeType, f.ID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	keep := defaultVersionRetention()
+	if retention != nil {
+		keep = *retention
+	}
+	orphans, err := pruneVersions(ctx, tx, f, keep)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	blobs.Remove(ctx, orphans)
+	return version, nil
+}
+
+// pruneVersions deletes all but the newest keep earlier versions of f inside
+// tx, refunding their size and releasing their blobs. It returns the
+// storage references to remove once tx commits.
+func pruneVersions(ctx context.Context, tx pgx.Tx, f *fileRecord, keep int) ([]string, error) {
+	rows, err := tx.Query(ctx, `
+		DELETE FROM file_versions WHERE id IN (
+			SELECT id FROM file_versions WHERE file_id=$1 ORDER BY version DESC OFFSET $2
+		) RETURNING hash, size`, f.ID, keep)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	var freed int64
+	for rows.Next() {
+		var hash string
+		var size int64
+		if err := rows.Scan(&hash, &size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+		freed += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+
+	if err := refundQuota(ctx, tx, f, freed); err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, hash := range hashes {
+		refs, err := blobs.Release(ctx, tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, refs...)
+	}
+	return orphans, nil
+}
+
+type VersionInfo struct {
+	Version   int       `json:"version"`
+	Size      int64     `json:"size"`
+	MimeType  string    `json:"mime_type"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current"`
+}
+
+const versionsQuery = `
+	SELECT version, hash, size, mime_type, upload_date, true FROM files WHERE id=$1
+	UNION ALL
+	SELECT version, hash, size, mime_type, created_at, false FROM file_versions WHERE file_id=$1`
+
+// ListVersions lists a file's current and earlier versions, newest first.
+func ListVersions(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	f, err := authorizeFile(c, c.Param("id"), userID, accessRead)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+
+	var retention *int
+	if err := db.DB.QueryRow(c, "SELECT version_retention FROM files WHERE id=$1", f.ID).Scan(&retention); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch versions"})
+		return
+	}
+	keep := defaultVersionRetention()
+	if retention != nil {
+		keep = *retention
+	}
+
+	rows, err := db.DB.Query(c, versionsQuery+" ORDER BY 1 DESC", f.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch versions"})
+		return
+	}
+	defer rows.Close()
+
+	versions := []VersionInfo{}
+	for rows.Next() {
+		var v VersionInfo
+		var hash string
+		if err := rows.Scan(&v.Version, &hash, &v.Size, &v.MimeType, &v.CreatedAt, &v.Current); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan version data"})
+			return
+		}
+		versions = append(versions, v)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"versions": versions, "retention": keep})
+}
+
+// findVersion looks up one version of a file, current or earlier.
+func findVersion(c *gin.Context, f *fileRecord) (hash string, size int64, mimeType string, ok bool) {
+	var v VersionInfo
+	err := db.DB.QueryRow(c, "SELECT * FROM ("+versionsQuery+") v WHERE version=$2", f.ID, c.Param("version")).
+		Scan(&v.Version, &hash, &v.Size, &v.MimeType, &v.CreatedAt, &v.Current)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return "", 0, "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch version"})
+		return "", 0, "", false
+	}
+	return hash, v.Size, v.MimeType, true
+}
+
+// DownloadVersion sends one version of a file as an attachment.
+func DownloadVersion(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	if _, err := strconv.Atoi(c.Param("version")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessRead)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	hash, _, mimeType, ok := findVersion(c, f)
+	if !ok {
+		return
+	}
+	serveBlob(c, hash, f.Filename, mimeType, true)
+}
+
+// RestoreVersion makes an earlier version's content current again. The
+// restored content becomes a new version, so nothing in between is lost.
+func RestoreVersion(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	if _, err := strconv.Atoi(c.Param("version")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessWrite)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	hash, size, mimeType, ok := findVersion(c, f)
+	if !ok {
+		return
+	}
+
+	version, err := addVersion(c, f, hash, size, mimeType, func(tx pgx.Tx) error {
+		return blobs.Retain(c, tx, hash)
+	})
+	switch {
+	case errors.Is(err, errVersionUnchanged):
+		c.JSON(http.StatusOK, gin.H{"status": "unchanged", "version": version})
+	case errors.Is(err, errQuotaExceeded):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Restoring exceeds available storage quota"})
+	case err != nil:
+		abortFileError(c, err)
+	default:
+		c.JSON(http.StatusOK, gin.H{"status": "version restored", "version": version, "restored_from": c.Param("version")})
+	}
+}
+
+// SetVersionRetention sets how many earlier versions a file keeps; null
+// goes back to FILE_VERSION_RETENTION. Versions past the new limit are
+// pruned at once.
+func SetVersionRetention(c *gin.Context) {
+	userID, _ := c.Get("user_id")
+	var req struct {
+		Keep *int `json:"keep"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Keep != nil && *req.Keep < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "keep must be a non-negative number or null"})
+		return
+	}
+	f, err := authorizeFile(c, c.Param("id"), userID, accessManage)
+	if err != nil {
+		abortFileError(c, err)
+		return
+	}
+	keep := defaultVersionRetention()
+	if req.Keep != nil {
+		keep = *req.Keep
+	}
+
+	tx, err := db.DB.Begin(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start transaction"})
+		return
+	}
+	defer tx.Rollback(c)
+	if _, err := tx.Exec(c, "UPDATE files SET version_retention=$1 WHERE id=$2", req.Keep, f.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention"})
+		return
+	}
+	orphans, err := pruneVersions(c, tx, f, keep)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prune versions"})
+		return
+	}
+	if err := tx.Commit(c); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+		return
+	}
+	blobs.Remove(c, orphans)
+
+	c.JSON(http.StatusOK, gin.H{"retention": keep})
+}
@@ -1,12 +1,18 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
 )
 
+// maxMultipartOverhead is a generous allowance for multipart boundaries and
+// part headers when comparing Content-Length with the remaining quota.
+const maxMultipartOverhead = 64 << 10
+
 func EnforceQuota() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("user_id")
@@ -15,8 +21,28 @@ func EnforceQuota() gin.HandlerFunc {
 			return
 		}
 
+		// Uploads into a group draw on the group's pool; the handler
+		// checks that the user may upload there
 		var quota int64
-		err := db.DB.QueryRow(c, "SELECT storage_quota FROM users WHERE id=$1", userID).Scan(&quota)
+		var err error
+		if groupID := c.Query("group_id"); groupID != "" {
+			err = db.DB.QueryRow(c, "SELECT storage_quota FROM groups WHERE id=$1", groupID).Scan(&quota)
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+				return
+			}
+		} else if fileID := c.Query("version_of"); fileID != "" {
+			// New versions are charged to the file's owner or group
+			err = db.DB.QueryRow(c, `
+				SELECT COALESCE((SELECT storage_quota FROM groups WHERE id = f.group_id), u.storage_quota)
+				FROM files f JOIN users u ON u.id = f.user_id WHERE f.id=$1`, fileID).Scan(&quota)
+			if errors.Is(err, pgx.ErrNoRows) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+		} else {
+			err = db.DB.QueryRow(c, "SELECT storage_quota FROM users WHERE id=$1", userID).Scan(&quota)
+		}
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Could not retrieve user quota"})
 			return
@@ -28,34 +54,17 @@ func EnforceQuota() gin.HandlerFunc {
 			})
 			return
 		}
-		form, err := c.MultipartForm()
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
-			return
-		}
-
-		var incomingSize int64 = 0
-		if files, ok := form.File["files"]; ok {
-			for _, f := range files {
-				incomingSize += f.Size
-			}
-		}
-
-		if incomingSize > quota {
+		// The upload handler streams the body and charges each stored file
+		// against the quota, so only refuse requests that cannot possibly fit.
+		if c.Request.ContentLength > 0 && quota < c.Request.ContentLength-maxMultipartOverhead {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
 				"error":     "Upload size exceeds available storage quota",
 				"quota":     quota,
-				"incoming":  incomingSize,
+				"incoming":  c.Request.ContentLength,
 			})
 			return
 		}
 
-		_, err = db.DB.Exec(c, "UPDATE users SET storage_quota = storage_quota - $1 WHERE id=$2", incomingSize, userID)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user quota1"})
-			return
-		}
-
 		c.Next()
 	}
 }
\ No newline at end of file
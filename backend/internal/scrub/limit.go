@@ -0,0 +1,61 @@
+package scrub
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// limiter paces reads to a byte rate shared by everything read through it.
+type limiter struct {
+	rate  int64 // bytes per second; 0 is unlimited
+	start time.Time
+	read  int64
+}
+
+func newLimiter(rate int64) *limiter {
+	return &limiter{rate: rate, start: time.Now()}
+}
+
+func (l *limiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l.rate <= 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+// wait sleeps until n more bytes fit in the budget.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.read += int64(n)
+	due := l.start.Add(time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep the pacing smooth
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.l.wait(lr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
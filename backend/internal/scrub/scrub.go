@@ -0,0 +1,306 @@
+// Package scrub periodically re-reads every stored blob, hashes its content
+// and compares it with the hash it was stored under, so silent corruption
+// in storage is noticed before a user downloads the file. Blobs that fail
+// are marked and no longer served.
+package scrub
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/envelope"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/utils"
+)
+
+// interval is how often a full pass starts, from SCRUB_INTERVAL (default
+// 7 days); "off" disables the schedule.
+func interval() time.Duration {
+	v := os.Getenv("SCRUB_INTERVAL")
+	if v == "" {
+		return 7 * 24 * time.Hour
+	}
+	if v == "off" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("scrub: invalid SCRUB_INTERVAL %q, using 168h", v)
+		return 7 * 24 * time.Hour
+	}
+	return d
+}
+
+// rate is the read budget in bytes per second, from SCRUB_RATE (default
+// 10 MiB/s); zero means unthrottled.
+func rate() int64 {
+	if n, err := strconv.ParseInt(os.Getenv("SCRUB_RATE"), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	return 10 << 20
+}
+
+// Result summarises one pass.
+type Result struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Verified   int       `json:"verified"`
+	Corrupt    int       `json:"corrupt"`
+	Missing    int       `json:"missing"`
+	Skipped    int       `json:"skipped"` // could not be read for reasons other than corruption
+	Bytes      int64     `json:"bytes"`
+}
+
+var (
+	running sync.Mutex
+	lastMu  sync.Mutex
+	last    *Result
+)
+
+// ErrBusy is returned by Run when a pass is already in progress.
+var ErrBusy = errors.New("integrity scrub already running")
+
+// Last returns the most recent completed pass, or nil.
+func Last() *Result {
+	lastMu.Lock()
+	defer lastMu.Unlock()
+	return last
+}
+
+// Start runs a pass every SCRUB_INTERVAL in the background.
+func Start(ctx context.Context) {
+	every := interval()
+	if every <= 0 {
+		log.Println("scrub: scheduled integrity checks disabled")
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := Run(ctx); err != nil && !errors.Is(err, ErrBusy) {
+					log.Printf("scrub: pass failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Run verifies every blob once, least recently verified first.
+func Run(ctx context.Context) (*Result, error) {
+	if !running.TryLock() {
+		return nil, ErrBusy
+	}
+	defer running.Unlock()
+	return run(ctx)
+}
+
+// Trigger starts a pass in the background and reports whether it did; it
+// does nothing when one is already running.
+func Trigger() bool {
+	if !running.TryLock() {
+		return false
+	}
+	go func() {
+		defer running.Unlock()
+		if _, err := run(context.Background()); err != nil {
+			log.Printf("scrub: pass failed: %v", err)
+		}
+	}()
+	return true
+}
+
+func run(ctx context.Context) (*Result, error) {
+	res := &Result{StartedAt: time.Now()}
+	limiter := newLimiter(rate())
+
+	// Walk in batches by verified_at so a restart resumes where the
+	// previous pass stopped; blobs checked during this pass sort last.
+	for {
+		hashes, err := nextBatch(ctx, res.StartedAt)
+		if err != nil {
+			return nil, err
+		}
+		if len(hashes) == 0 {
+			break
+		}
+		for _, hash := range hashes {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			verify(ctx, hash, limiter, res)
+		}
+	}
+
+	res.FinishedAt = time.Now()
+	log.Printf("scrub: verified %d blobs (%d bytes): %d corrupt, %d missing, %d skipped",
+		res.Verified, res.Bytes, res.Corrupt, res.Missing, res.Skipped)
+
+	lastMu.Lock()
+	last = res
+	lastMu.Unlock()
+	return res, nil
+}
+
+func nextBatch(ctx context.Context, since time.Time) ([]string, error) {
+	rows, err := db.DB.Query(ctx, `
+		SELECT hash FROM blobs
+		WHERE verified_at IS NULL OR verified_at < $1
+		ORDER BY verified_at NULLS FIRST
+		LIMIT 100`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// verify hashes one blob's content and records the outcome.
+func verify(ctx context.Context, hash string, limiter *limiter, res *Result) {
+	blob, err := blobs.Get(ctx, db.DB, hash)
+	if errors.Is(err, blobs.ErrNotFound) {
+		return // deleted since the batch was read
+	}
+	if err != nil {
+		log.Printf("scrub: load blob %s: %v", hash, err)
+		skip(ctx, hash, res)
+		return
+	}
+
+	status, detail := check(ctx, blob, limiter, res)
+	switch status {
+	case "":
+		log.Printf("scrub: blob %s unreadable: %s", hash, detail)
+		skip(ctx, hash, res)
+		return
+	case blobs.IntegrityCorrupt:
+		res.Corrupt++
+		log.Printf("scrub: blob %s is corrupt: %s", hash, detail)
+	case blobs.IntegrityMissing:
+		res.Missing++
+		log.Printf("scrub: blob %s is missing: %s", hash, detail)
+	}
+	res.Verified++
+
+	_, err = db.DB.Exec(ctx, `
+		UPDATE blobs SET integrity=$1, integrity_error=$2, verified_at=CURRENT_TIMESTAMP
+		WHERE hash=$3`,
+		status, nullIfEmpty(detail), hash)
+	if err != nil {
+		log.Printf("scrub: record result for %s: %v", hash, err)
+	}
+}
+
+// skip pushes a blob that could not be checked to the back of the queue
+// without changing its recorded result.
+func skip(ctx context.Context, hash string, res *Result) {
+	res.Skipped++
+	db.DB.Exec(ctx, "UPDATE blobs SET verified_at=CURRENT_TIMESTAMP WHERE hash=$1", hash)
+}
+
+// check returns the integrity status and, for failures, a description.
+// An empty status means the content could not be read for a reason that
+// says nothing about its integrity, such as a network error.
+func check(ctx context.Context, blob *blobs.Blob, limiter *limiter, res *Result) (string, string) {
+	rc, err := blob.Open(ctx)
+	if errors.Is(err, storage.ErrNotFound) {
+		return blobs.IntegrityMissing, err.Error()
+	}
+	if err != nil {
+		return "", err.Error()
+	}
+	defer rc.Close()
+
+	counter := &countingReader{r: limiter.reader(ctx, rc)}
+	sum, err := utils.ReaderHash(counter)
+	res.Bytes += counter.n
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return blobs.IntegrityMissing, err.Error()
+	case corruption(err):
+		return blobs.IntegrityCorrupt, err.Error()
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return truncated(ctx, blob, err)
+	case err != nil:
+		return "", err.Error()
+	case counter.n != blob.Size:
+		return blobs.IntegrityCorrupt, "size mismatch: read " + strconv.FormatInt(counter.n, 10) +
+			" bytes, expected " + strconv.FormatInt(blob.Size, 10)
+	case sum != blob.Hash:
+		return blobs.IntegrityCorrupt, "hash mismatch: content hashes to " + sum
+	}
+	return blobs.IntegrityOK, ""
+}
+
+// corruption reports whether a read error means the stored bytes are bad
+// rather than temporarily unreachable.
+func corruption(err error) bool {
+	var flateErr flate.CorruptInputError
+	return errors.Is(err, envelope.ErrCorrupt) ||
+		errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.As(err, &flateErr)
+}
+
+// truncated decides what a body that ended early means. A connection cut
+// mid-transfer ends it the same way as a short stored object, so the blob
+// is only corrupt when storage holds fewer bytes than were written.
+func truncated(ctx context.Context, blob *blobs.Blob, err error) (string, string) {
+	if blob.Chunked || blob.StorageKey == "" {
+		return "", err.Error()
+	}
+	store, key, rerr := storage.Resolve(blob.StorageKey)
+	if rerr != nil {
+		return "", err.Error()
+	}
+	info, serr := store.Stat(ctx, key)
+	if errors.Is(serr, storage.ErrNotFound) {
+		return blobs.IntegrityMissing, serr.Error()
+	}
+	if serr != nil || info.Size >= blob.StoredSize {
+		return "", err.Error()
+	}
+	return blobs.IntegrityCorrupt, "stored body is " + strconv.FormatInt(info.Size, 10) +
+		" bytes, expected " + strconv.FormatInt(blob.StoredSize, 10)
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,179 @@
+package searchql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/extract"
+)
+
+// now is the time relative dates count back from.
+var now = time.Now
+
+// Compile parses a query and returns an SQL condition on the files table,
+// handing every value to arg, which returns the placeholder to use for it.
+// Columns are unqualified, so the condition fits any query over files.
+func Compile(query string, arg func(interface{}) string) (string, error) {
+	n, err := parse(query)
+	if err != nil {
+		return "", err
+	}
+	return n.sql(&compiler{arg: arg, now: now()})
+}
+
+type compiler struct {
+	arg func(interface{}) string
+	now time.Time
+}
+
+func (n andNode) sql(c *compiler) (string, error) {
+	return binary(c, n.left, "AND", n.right)
+}
+
+func (n orNode) sql(c *compiler) (string, error) {
+	return binary(c, n.left, "OR", n.right)
+}
+
+func binary(c *compiler, left node, op string, right node) (string, error) {
+	l, err := left.sql(c)
+	if err != nil {
+		return "", err
+	}
+	r, err := right.sql(c)
+	if err != nil {
+		return "", err
+	}
+	return "(" + l + " " + op + " " + r + ")", nil
+}
+
+// Every term is true or false, never NULL, so NOT selects exactly the
+// files the term does not.
+func (n notNode) sql(c *compiler) (string, error) {
+	s, err := n.operand.sql(c)
+	if err != nil {
+		return "", err
+	}
+	return "NOT " + s, nil
+}
+
+func (t term) sql(c *compiler) (string, error) {
+	if t.op != "=" && (t.field == "name" || t.field == "type" || t.field == "tag" || t.field == "text") {
+		return "", errorf(t.pos, "%s cannot be compared with %s", t.field, t.op)
+	}
+
+	switch t.field {
+	case "name":
+		return "(filename ILIKE " + c.arg(contains(t.value)) + ")", nil
+	case "type":
+		return "(COALESCE(mime_type, '') ILIKE " + c.arg(contains(t.value)) + ")", nil
+	case "tag":
+		// Tags are stored lowercased with single spaces
+		tag := strings.ToLower(strings.Join(strings.Fields(t.value), " "))
+		return "(" + c.arg(tag) + " = ANY(COALESCE(tags, '{}')))", nil
+	case "text":
+		return fmt.Sprintf("(hash IN (SELECT hash FROM blob_text WHERE tsv @@ websearch_to_tsquery('%s', %s)))",
+			extract.Config, c.arg(t.value)), nil
+	case "size":
+		n, err := parseSize(t.value)
+		if err != nil {
+			return "", errorf(t.pos, "%v", err)
+		}
+		return "(size " + t.op + " " + c.arg(n) + ")", nil
+	case "downloads":
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil || n < 0 {
+			return "", errorf(t.pos, "invalid download count %q", t.value)
+		}
+		return "(COALESCE(download_count, 0) " + t.op + " " + c.arg(n) + ")", nil
+	case "date":
+		return t.date(c)
+	}
+	return "", errorf(t.pos, "unknown field %q", t.field)
+}
+
+// contains is an ILIKE pattern matching the value anywhere, with the
+// pattern characters in it escaped.
+func contains(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(v)
+	return "%" + v + "%"
+}
+
+var sizePattern = regexp.MustCompile(`^(?i)(\d+(?:\.\d+)?)\s*(b|k|kb|m|mb|g|gb|t|tb)?$`)
+
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40,
+}
+
+// parseSize reads a byte count such as 500, 64KB or 1.5GB. Units are
+// powers of 1024.
+func parseSize(v string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(v)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	n *= sizeUnits[strings.ToLower(m[2])]
+	if n > 1<<62 {
+		return 0, fmt.Errorf("size %q is too large", v)
+	}
+	return int64(n), nil
+}
+
+var agePattern = regexp.MustCompile(`^(\d{1,5})([hdwmy])$`)
+
+// date compares the upload time with a day, 2006-01-02, or an age such as
+// 12h, 3d, 2w, 6m or 1y, which stands for that long before now: date>2w
+// is newer than two weeks. A day alone matches uploads on that day, an
+// age alone uploads since then.
+func (t term) date(c *compiler) (string, error) {
+	const column = "COALESCE(upload_date, '-infinity')"
+
+	if m := agePattern.FindStringSubmatch(t.value); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		at := c.now
+		switch m[2] {
+		case "h":
+			at = at.Add(-time.Duration(n) * time.Hour)
+		case "d":
+			at = at.AddDate(0, 0, -n)
+		case "w":
+			at = at.AddDate(0, 0, -7*n)
+		case "m":
+			at = at.AddDate(0, -n, 0)
+		case "y":
+			at = at.AddDate(-n, 0, 0)
+		}
+		op := t.op
+		if op == "=" {
+			op = ">="
+		}
+		return "(" + column + " " + op + " " + c.arg(at) + ")", nil
+	}
+
+	day, err := time.Parse("2006-01-02", t.value)
+	if err != nil {
+		return "", errorf(t.pos, "invalid date %q, use 2006-01-02 or an age such as 2w", t.value)
+	}
+	next := day.AddDate(0, 0, 1)
+	switch t.op {
+	case "<":
+		return "(" + column + " < " + c.arg(day) + ")", nil
+	case "<=":
+		return "(" + column + " < " + c.arg(next) + ")", nil
+	case ">":
+		return "(" + column + " >= " + c.arg(next) + ")", nil
+	case ">=":
+		return "(" + column + " >= " + c.arg(day) + ")", nil
+	}
+	return "(" + column + " >= " + c.arg(day) + " AND " + column + " < " + c.arg(next) + ")", nil
+}
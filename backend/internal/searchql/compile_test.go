@@ -0,0 +1,250 @@
+package searchql
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compile runs Compile with placeholders $1, $2, … and returns the
+// arguments it was handed.
+func compile(query string) (string, []interface{}, error) {
+	var args []interface{}
+	sql, err := Compile(query, func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	})
+	return sql, args, err
+}
+
+// quote writes v as a quoted query value.
+func quote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
+
+func TestCompileValuesOnlyInArgs(t *testing.T) {
+	hostile := []string{
+		`x'; DROP TABLE files; --`,
+		`' OR '1'='1`,
+		`a"b`,
+		`50%_off`,
+		`back\slash`,
+		`$1`,
+		`) OR true --`,
+	}
+	tests := []struct {
+		field string
+		want  func(v string) interface{}
+	}{
+		{"name", func(v string) interface{} { return contains(v) }},
+		{"type", func(v string) interface{} { return contains(v) }},
+		{"tag", func(v string) interface{} { return strings.ToLower(strings.Join(strings.Fields(v), " ")) }},
+		{"text", func(v string) interface{} { return v }},
+	}
+	for _, tt := range tests {
+		// The SQL must be the same as for a harmless value, whatever the
+		// value holds
+		safe, _, err := compile(tt.field + ":x")
+		if err != nil {
+			t.Fatalf("%s:x: %v", tt.field, err)
+		}
+		for _, v := range hostile {
+			q := tt.field + ":" + quote(v)
+			sql, args, err := compile(q)
+			if err != nil {
+				t.Errorf("%s: %v", q, err)
+				continue
+			}
+			if sql != safe {
+				t.Errorf("%s: SQL %q differs from %q", q, sql, safe)
+			}
+			if len(args) != 1 || args[0] != tt.want(v) {
+				t.Errorf("%s: args %q, want [%q]", q, args, tt.want(v))
+			}
+		}
+	}
+
+	// Dates are parsed, so anything else is rejected before reaching SQL
+	for _, v := range hostile {
+		q := "date:" + quote(v)
+		if sql, _, err := compile(q); err == nil {
+			t.Errorf("%s: compiled to %q, want an error", q, sql)
+		}
+	}
+}
+
+func TestCompileEscapesLikePatterns(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`name:report`, `%report%`},
+		{`name:"50%"`, `%50\%%`},
+		{`name:a_b`, `%a\_b%`},
+		{`name:"c:\\temp"`, `%c:\\temp%`},
+		{`type:"%_\\"`, `%\%\_\\%`},
+	}
+	for _, tt := range tests {
+		_, args, err := compile(tt.query)
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			continue
+		}
+		if len(args) != 1 || args[0] != tt.want {
+			t.Errorf("%s: args %q, want [%q]", tt.query, args, tt.want)
+		}
+	}
+}
+
+func TestCompileOperators(t *testing.T) {
+	tests := []struct {
+		query string
+		sql   string
+		err   string
+	}{
+		{query: "size>1MB", sql: "(size > $1)"},
+		{query: "size<=512", sql: "(size <= $1)"},
+		{query: "downloads>=3", sql: "(COALESCE(download_count, 0) >= $1)"},
+		{query: "downloads:3", sql: "(COALESCE(download_count, 0) = $1)"},
+		{query: "name>3", err: "name cannot be compared with >"},
+		{query: "type<=pdf", err: "type cannot be compared with <="},
+		{query: "tag>=a", err: "tag cannot be compared with >="},
+		{query: "text<x", err: "text cannot be compared with <"},
+		{query: "size>huge", err: `invalid size "huge"`},
+		{query: "size>99999999TB", err: "too large"},
+		{query: "downloads>-1", err: "invalid download count"},
+		{query: "date>yesterday", err: "invalid date"},
+	}
+	for _, tt := range tests {
+		sql, _, err := compile(tt.query)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.query, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || sql != tt.sql {
+			t.Errorf("%s: %q, %v, want %q", tt.query, sql, err, tt.sql)
+		}
+	}
+}
+
+func TestCompileDates(t *testing.T) {
+	defer func(prev func() time.Time) { now = prev }(now)
+	at := time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return at }
+	day := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	const col = "COALESCE(upload_date, '-infinity')"
+
+	tests := []struct {
+		query string
+		sql   string
+		args  []interface{}
+	}{
+		{"date>2w", "(" + col + " > $1)", []interface{}{at.AddDate(0, 0, -14)}},
+		{"date:3d", "(" + col + " >= $1)", []interface{}{at.AddDate(0, 0, -3)}},
+		{"uploaded<12h", "(" + col + " < $1)", []interface{}{at.Add(-12 * time.Hour)}},
+		{"date:2026-01-02", "(" + col + " >= $1 AND " + col + " < $2)", []interface{}{day, day.AddDate(0, 0, 1)}},
+		{"date>2026-01-02", "(" + col + " >= $1)", []interface{}{day.AddDate(0, 0, 1)}},
+		{"date<=2026-01-02", "(" + col + " < $1)", []interface{}{day.AddDate(0, 0, 1)}},
+	}
+	for _, tt := range tests {
+		sql, args, err := compile(tt.query)
+		if err != nil || sql != tt.sql || fmt.Sprint(args) != fmt.Sprint(tt.args) {
+			t.Errorf("%s: %q %v, %v, want %q %v", tt.query, sql, args, err, tt.sql, tt.args)
+		}
+	}
+}
+
+func TestCompilePrecedence(t *testing.T) {
+	const (
+		a = "(filename ILIKE $1)"
+		b = "(filename ILIKE $2)"
+		c = "(filename ILIKE $3)"
+	)
+	tests := []struct {
+		query string
+		sql   string
+	}{
+		{"a b", "(" + a + " AND " + b + ")"},
+		{"a AND b", "(" + a + " AND " + b + ")"},
+		{"a OR b c", "(" + a + " OR (" + b + " AND " + c + "))"},
+		{"a b OR c", "((" + a + " AND " + b + ") OR " + c + ")"},
+		{"(a OR b) c", "((" + a + " OR " + b + ") AND " + c + ")"},
+		{"-a b", "(NOT " + a + " AND " + b + ")"},
+		{"NOT a OR b", "(NOT " + a + " OR " + b + ")"},
+		{"NOT (a OR b)", "NOT (" + a + " OR " + b + ")"},
+		{"a OR b OR c", "((" + a + " OR " + b + ") OR " + c + ")"},
+		// A - on its own is a word, not a NOT
+		{"- a", "(" + a + " AND " + b + ")"},
+		{"--a", "NOT NOT " + a},
+	}
+	for _, tt := range tests {
+		sql, _, err := compile(tt.query)
+		if err != nil || sql != tt.sql {
+			t.Errorf("%s: %q, %v, want %q", tt.query, sql, err, tt.sql)
+		}
+	}
+}
+
+func TestCompileErrorPositions(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{"(a", 0, "unclosed ("},
+		{"a (b OR c", 2, "unclosed ("},
+		{"a)", 1, "unexpected )"},
+		{"a OR", 4, "unexpected end of query"},
+		{"AND a", 0, "unexpected AND"},
+		{"a ()", 3, "unexpected )"},
+		{`name:"abc`, 5, "unterminated quote"},
+		{`a "b`, 2, "unterminated quote"},
+		{"foo:bar", 0, `unknown field "foo"`},
+		{"a size:", 2, "missing value for size"},
+		{"a name>b", 2, "name cannot be compared with >"},
+		{"a b size>x", 4, `invalid size "x"`},
+	}
+	for _, tt := range tests {
+		_, _, err := compile(tt.query)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%s: error %v, want a SyntaxError", tt.query, err)
+			continue
+		}
+		if se.Pos != tt.pos || se.Msg != tt.msg {
+			t.Errorf("%s: %q at %d, want %q at %d", tt.query, se.Msg, se.Pos, tt.msg, tt.pos)
+		}
+	}
+}
+
+func TestCompileLimits(t *testing.T) {
+	terms := func(n int) string {
+		return strings.TrimSpace(strings.Repeat("a ", n))
+	}
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{"max terms", terms(maxTerms), ""},
+		{"too many terms", terms(maxTerms + 1), fmt.Sprintf("more than %d terms", maxTerms)},
+		{"max depth", strings.Repeat("(", maxDepth) + "a" + strings.Repeat(")", maxDepth), ""},
+		{"too deep", strings.Repeat("(", maxDepth+1) + "a" + strings.Repeat(")", maxDepth+1), fmt.Sprintf("deeper than %d", maxDepth)},
+		{"too many NOTs", strings.Repeat("NOT ", maxDepth+1) + "a", fmt.Sprintf("deeper than %d", maxDepth)},
+		{"too long", strings.Repeat("x", maxQueryLength+1), fmt.Sprintf("longer than %d bytes", maxQueryLength)},
+		{"max length", strings.Repeat("x", maxQueryLength), ""},
+	}
+	for _, tt := range tests {
+		_, _, err := compile(tt.query)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
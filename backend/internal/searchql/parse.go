@@ -0,0 +1,341 @@
+// Package searchql parses the file search query language and compiles it
+// to a parameterized SQL condition on files:
+//
+//	tag:invoice -tag:paid size>1MB type:pdf
+//	(name:report OR name:summary) date>2w
+//
+// Terms next to each other must all match; AND, OR, NOT or a leading -
+// and parentheses combine them, with NOT binding tightest and OR loosest.
+// A term is a bare word or "quoted phrase" matched against the file name,
+// or a field followed by :, =, <, <=, > or >= and a value. Every value
+// reaches the database as an argument, never as SQL.
+package searchql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits that keep a query, and the SQL it becomes, small.
+const (
+	maxQueryLength = 1024
+	maxTerms       = 64
+	maxDepth       = 32
+)
+
+// SyntaxError reports a query that cannot be parsed or compiled, with the
+// byte offset it was found at.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("query: %s at position %d", e.Msg, e.Pos)
+}
+
+func errorf(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// node is a parsed query.
+type node interface {
+	sql(c *compiler) (string, error)
+}
+
+type andNode struct{ left, right node }
+type orNode struct{ left, right node }
+type notNode struct{ operand node }
+
+// term is a single condition. Bare words have the field "name".
+type term struct {
+	pos   int
+	field string
+	op    string
+	value string
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+	tokTerm
+)
+
+type token struct {
+	kind tokenKind
+	term term
+}
+
+// fields maps every field name, and its aliases, to the field it means.
+var fields = map[string]string{
+	"name":      "name",
+	"filename":  "name",
+	"type":      "type",
+	"mime":      "type",
+	"tag":       "tag",
+	"size":      "size",
+	"date":      "date",
+	"uploaded":  "date",
+	"downloads": "downloads",
+	"text":      "text",
+}
+
+// ops are the comparison operators, longest first so >= is not read as >.
+var ops = []string{">=", "<=", ">", "<", "="}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(s) {
+		switch b := s[i]; {
+		case isSpace(b):
+			i++
+		case b == '(':
+			toks = append(toks, token{kind: tokLParen, term: term{pos: i}})
+			i++
+		case b == ')':
+			toks = append(toks, token{kind: tokRParen, term: term{pos: i}})
+			i++
+		case b == '-' && i+1 < len(s) && !isSpace(s[i+1]) && s[i+1] != ')':
+			toks = append(toks, token{kind: tokNot, term: term{pos: i}})
+			i++
+		case b == '"':
+			value, next, err := quoted(s, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, token{kind: tokTerm, term: term{pos: i, field: "name", op: "=", value: value}})
+			i = next
+		default:
+			start := i
+			for i < len(s) && !isSpace(s[i]) && s[i] != '(' && s[i] != ')' && s[i] != '"' {
+				i++
+			}
+			word := s[start:i]
+			switch word {
+			case "AND":
+				toks = append(toks, token{kind: tokAnd, term: term{pos: start}})
+				continue
+			case "OR":
+				toks = append(toks, token{kind: tokOr, term: term{pos: start}})
+				continue
+			case "NOT":
+				toks = append(toks, token{kind: tokNot, term: term{pos: start}})
+				continue
+			}
+
+			t, err := fieldTerm(start, word)
+			if err != nil {
+				return nil, err
+			}
+			// field:"quoted value"
+			if t.value == "" && i < len(s) && s[i] == '"' {
+				if t.value, i, err = quoted(s, i); err != nil {
+					return nil, err
+				}
+			}
+			if t.value == "" {
+				return nil, errorf(start, "missing value for %s", t.field)
+			}
+			toks = append(toks, token{kind: tokTerm, term: t})
+		}
+	}
+	return append(toks, token{kind: tokEOF, term: term{pos: len(s)}}), nil
+}
+
+// fieldTerm splits a word into field, operator and value. Words without a
+// field prefix, such as report.pdf or 10:30, search the file name.
+func fieldTerm(pos int, word string) (term, error) {
+	bare := term{pos: pos, field: "name", op: "=", value: word}
+	i := strings.IndexAny(word, ":<>=")
+	if i <= 0 {
+		return bare, nil
+	}
+	name := strings.ToLower(word[:i])
+	field, ok := fields[name]
+	if !ok {
+		if strings.Trim(name, "abcdefghijklmnopqrstuvwxyz_") == "" {
+			return term{}, errorf(pos, "unknown field %q", name)
+		}
+		return bare, nil
+	}
+
+	rest := strings.TrimPrefix(word[i:], ":")
+	op := "="
+	for _, o := range ops {
+		if strings.HasPrefix(rest, o) {
+			op, rest = o, rest[len(o):]
+			break
+		}
+	}
+	return term{pos: pos, field: field, op: op, value: rest}, nil
+}
+
+// quoted reads the string starting at the quote at s[i], in which \" and
+// \\ stand for themselves, and returns it and the offset after it.
+func quoted(s string, i int) (string, int, error) {
+	var b strings.Builder
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '"':
+			return b.String(), j + 1, nil
+		case '\\':
+			if j+1 < len(s) && (s[j+1] == '"' || s[j+1] == '\\') {
+				j++
+			}
+		}
+		b.WriteByte(s[j])
+	}
+	return "", 0, errorf(i, "unterminated quote")
+}
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int
+	terms int
+}
+
+func parse(s string) (node, error) {
+	if len(s) > maxQueryLength {
+		return nil, errorf(maxQueryLength, "query is longer than %d bytes", maxQueryLength)
+	}
+	toks, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, errorf(t.term.pos, "unexpected %s", describe(t))
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+// and reads terms joined by AND, or by nothing at all.
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokEOF, tokRParen, tokOr:
+			return left, nil
+		case tokAnd:
+			p.next()
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if p.peek().kind != tokNot {
+		return p.primary()
+	}
+	t := p.next()
+	if err := p.enter(t); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	operand, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return notNode{operand}, nil
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokTerm:
+		if p.terms++; p.terms > maxTerms {
+			return nil, errorf(t.term.pos, "more than %d terms", maxTerms)
+		}
+		return t.term, nil
+	case tokLParen:
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, errorf(t.term.pos, "unclosed (")
+		}
+		return n, nil
+	}
+	return nil, errorf(t.term.pos, "unexpected %s", describe(t))
+}
+
+func (p *parser) enter(t token) error {
+	if p.depth++; p.depth > maxDepth {
+		return errorf(t.term.pos, "query nests deeper than %d", maxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() { p.depth-- }
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokLParen:
+		return "("
+	case tokRParen:
+		return ")"
+	case tokAnd:
+		return "AND"
+	case tokOr:
+		return "OR"
+	case tokNot:
+		return "NOT"
+	}
+	return fmt.Sprintf("%q", t.term.value)
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrTooLarge is returned by NewTempBlob when the input exceeds its limit.
+var ErrTooLarge = errors.New("blob exceeds size limit")
+
+// StagingDir is where uploads are spooled before being committed. It lives
+// inside the local store so commits there are a single rename.
+var StagingDir = os.TempDir()
+
+// FileAdopter is implemented by backends that can take ownership of a file
+// on local disk without copying it.
+type FileAdopter interface {
+	Adopt(ctx context.Context, key, path string) error
+}
+
+// TempBlob is an incoming body spooled to disk and hashed in the same pass.
+type TempBlob struct {
+	file *os.File
+	Hash string // hex SHA-256
+	Size int64
+}
+
+// NewTempBlob copies r to a staging file while hashing it. It stops with
+// ErrTooLarge as soon as more than limit bytes arrive; a negative limit
+// means no limit.
+func NewTempBlob(r io.Reader, limit int64) (*TempBlob, error) {
+	f, err := os.CreateTemp(StagingDir, "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	t := &TempBlob{file: f}
+
+	if limit >= 0 {
+		// Read one byte past the limit so overflow can be told apart
+		// from a body of exactly limit bytes.
+		r = io.LimitReader(r, limit+1)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil && limit >= 0 && n > limit {
+		err = ErrTooLarge
+	}
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	t.Hash = hex.EncodeToString(h.Sum(nil))
+	t.Size = n
+	return t, nil
+}
+
+// Commit stores the staged body under key. Backends that can adopt local
+// files get it renamed into place, others receive a copy.
+func (t *TempBlob) Commit(ctx context.Context, store BlobStore, key string) error {
+	if a, ok := store.(FileAdopter); ok {
+		if err := t.file.Close(); err != nil {
+			return err
+		}
+		if err := a.Adopt(ctx, key, t.file.Name()); err != nil {
+			return err
+		}
+		t.file = nil
+		return nil
+	}
+
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := store.Put(ctx, key, t.file)
+	return err
+}
+
+// Rewind returns the staged body positioned at its start.
+func (t *TempBlob) Rewind() (io.Reader, error) {
+	if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return t.file, nil
+}
+
+// Close discards the staging file unless it was adopted by Commit.
+func (t *TempBlob) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	t.file.Close()
+	err := os.Remove(t.file.Name())
+	t.file = nil
+	return err
+}
+
+// OpenTempBlob wraps a staging file that was written and hashed elsewhere,
+// such as a finished resumable upload, so it can be committed like any
+// other upload. The blob gets its own hard link, so path is left in place
+// whether the blob is committed or discarded. path must be in StagingDir.
+func OpenTempBlob(path, hash string, size int64) (*TempBlob, error) {
+	link := filepath.Join(filepath.Dir(path), filepath.Base(path)+".commit")
+	os.Remove(link)
+	if err := os.Link(path, link); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(link)
+	if err != nil {
+		os.Remove(link)
+		return nil, err
+	}
+	return &TempBlob{file: f, Hash: hash, Size: size}, nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var ingestSizes = []struct {
+	name string
+	size int
+}{
+	{"1MB", 1 << 20},
+	{"16MB", 16 << 20},
+	{"128MB", 128 << 20},
+}
+
+// benchIngest runs ingest once per iteration for each body size, against a
+// local store with its staging directory inside it, as the server sets up.
+func benchIngest(b *testing.B, ingest func(ctx context.Context, store *LocalStore, body io.Reader, key string) error) {
+	for _, sz := range ingestSizes {
+		b.Run(sz.name, func(b *testing.B) {
+			body := make([]byte, sz.size)
+			rand.Read(body)
+
+			root := b.TempDir()
+			store, err := NewLocalStore(root)
+			if err != nil {
+				b.Fatal(err)
+			}
+			staging := StagingDir
+			StagingDir = filepath.Join(root, ".staging")
+			defer func() { StagingDir = staging }()
+			if err := os.MkdirAll(StagingDir, 0o755); err != nil {
+				b.Fatal(err)
+			}
+
+			ctx := context.Background()
+			b.SetBytes(int64(sz.size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := ingest(ctx, store, bytes.NewReader(body), "blob/"+strconv.Itoa(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkIngestStreaming is the upload path: the body is hashed while it
+// is spooled, then renamed into the store.
+func BenchmarkIngestStreaming(b *testing.B) {
+	benchIngest(b, func(ctx context.Context, store *LocalStore, body io.Reader, key string) error {
+		t, err := NewTempBlob(body, -1)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		return t.Commit(ctx, store, key)
+	})
+}
+
+// BenchmarkIngestSaveThenRehash is the path it replaced: the body is saved
+// to a temporary file, read back to hash it, then read again into the
+// store.
+func BenchmarkIngestSaveThenRehash(b *testing.B) {
+	benchIngest(b, func(ctx context.Context, store *LocalStore, body io.Reader, key string) error {
+		f, err := os.CreateTemp(StagingDir, "upload-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err := io.Copy(f, body); err != nil {
+			return err
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		_ = hex.EncodeToString(h.Sum(nil))
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = store.Put(ctx, key, f)
+		return err
+	})
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist in the store.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobInfo describes a stored blob.
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore is the interface every file body backend implements.
+// Keys are slash separated and relative to the backend root.
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing any existing blob,
+	// and returns the number of bytes written.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the whole blob for reading.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange opens length bytes starting at offset. A negative length
+	// reads to the end of the blob.
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every blob whose key starts with prefix.
+	List(ctx context.Context, prefix string, fn func(BlobInfo) error) error
+}
+
+// Store is the backend new blobs are written to, set up by InitStore.
+var Store BlobStore
+
+// StoreName is the name of Store as it appears in references.
+var StoreName string
+
+// backends holds every configured backend by name so rows written while
+// another backend was the default can still be read.
+var backends = map[string]BlobStore{}
+
+// InitStore registers the configured backends and picks the default from
+// STORAGE_BACKEND ("local" or "s3", default "local"). The local backend is
+// always registered so existing uploads stay readable.
+func InitStore() error {
+	dir := os.Getenv("STORAGE_LOCAL_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	local, err := NewLocalStore(dir)
+	if err != nil {
+		return err
+	}
+	backends["local"] = local
+
+	StagingDir = filepath.Join(dir, ".staging")
+	if err := os.MkdirAll(StagingDir, 0o755); err != nil {
+		return err
+	}
+
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = "local"
+	}
+
+	if backend == "s3" || os.Getenv("S3_BUCKET") != "" {
+		s3, err := NewS3Store(S3ConfigFromEnv())
+		if err != nil {
+			return err
+		}
+		backends["s3"] = s3
+	}
+
+	s, ok := backends[backend]
+	if !ok {
+		return fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+	Store, StoreName = s, backend
+
+	fmt.Println("Using", backend, "blob storage")
+	return nil
+}
+
+// Backends returns every configured backend by name.
+func Backends() map[string]BlobStore {
+	all := make(map[string]BlobStore, len(backends))
+	for name, s := range backends {
+		all[name] = s
+	}
+	return all
+}
+
+// Ref builds the value stored in files.path for a key in the default store.
+func Ref(key string) string {
+	return StoreName + ":" + key
+}
+
+// Resolve splits a files.path reference into its backend and key. Values
+// without a known backend prefix are treated as local keys.
+func Resolve(ref string) (BlobStore, string, error) {
+	name, key, found := strings.Cut(ref, ":")
+	if !found || (name != "local" && name != "s3") {
+		name, key = "local", ref
+	}
+
+	s, ok := backends[name]
+	if !ok {
+		return nil, "", fmt.Errorf("storage backend %q is not configured", name)
+	}
+	return s, key, nil
+}
+
+// HashKey returns the content-addressed key for a hex SHA-256, fanned out
+// over two directory levels: "abcdef…" becomes "ab/cd/abcdef…".
+func HashKey(hash string) string {
+	if len(hash) < 4 {
+		return hash
+	}
+	return hash[:2] + "/" + hash[2:4] + "/" + hash
+}
@@ -14,9 +14,14 @@ func FileHash(path string) (string, error) {
  }
  defer file.Close()
 
+ return ReaderHash(file)
+}
+
+// ReaderHash returns the hex SHA-256 of everything read from r.
+func ReaderHash(r io.Reader) (string, error) {
  hash := sha256.New()
- if _, err := io.Copy(hash, file); err != nil {
+ if _, err := io.Copy(hash, r); err != nil {
   return "", err
  }
  return hex.EncodeToString(hash.Sum(nil)), nil
-}
\ No newline at end of file
+}
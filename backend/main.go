@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 	"os"
@@ -9,9 +10,15 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/blobs"
 	"github.com/Deeks779/balkanid-file-vault/backend/internal/db"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/envelope"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/extract"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/gc"
 	"github.com/Deeks779/balkanid-file-vault/backend/internal/handlers"
 	"github.com/Deeks779/balkanid-file-vault/backend/internal/middleware"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/scrub"
+	"github.com/Deeks779/balkanid-file-vault/backend/internal/storage"
 )
 
 func main() {
@@ -23,6 +30,34 @@ func main() {
 		log.Fatal("Failed to connect to DB:", err)
 	}
 
+	// Set up blob storage
+	if err := storage.InitStore(); err != nil {
+		log.Fatal("Failed to initialise storage:", err)
+	}
+	if err := envelope.Init(); err != nil {
+		log.Fatal("Failed to load encryption keys:", err)
+	}
+
+	// Maintenance command: `server rotate-keys` re-wraps data keys with the
+	// current ENCRYPTION_KEY and exits
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		n, err := blobs.RotateKeys(context.Background())
+		if err != nil {
+			log.Fatal("Key rotation failed:", err)
+		}
+		log.Printf("Re-wrapped %d data keys", n)
+		return
+	}
+
+	// Reclaim orphaned blobs and stale uploads in the background
+	gc.Start(context.Background())
+	// Re-verify stored content against its hash on a schedule
+	scrub.Start(context.Background())
+	// Permanently delete files that have been in the trash too long
+	handlers.StartTrashPurge(context.Background())
+	// Extract document text for content search
+	extract.Start(context.Background())
+
 	r := gin.Default()
 	// CORS middleware configuration
 	corsOrigin := os.Getenv("CORS_ORIGIN")
@@ -32,9 +67,9 @@ func main() {
     }
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{corsOrigin},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Range", "If-Range", "If-None-Match", "If-Modified-Since", "X-Share-Password"},
+		ExposeHeaders:    []string{"Content-Length", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Accept-Ranges", "Content-Range", "Content-Disposition", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -44,10 +79,17 @@ func main() {
 	r.POST("/login", handlers.Login)
 
 	r.GET("/public/:id", handlers.PublicFile)
+	r.HEAD("/public/:id", handlers.PublicFile)
 	r.GET("/preview/:id", handlers.PublicFilePreview)
+	r.HEAD("/preview/:id", handlers.PublicFilePreview)
+	r.GET("/s/:token", handlers.SharedLinkFile)
+	r.HEAD("/s/:token", handlers.SharedLinkFile)
 
 	r.GET("/files/public", handlers.ListPublicFiles)
 
+	// tus clients discover the server's capabilities before signing in
+	r.OPTIONS("/api/uploads", handlers.TusOptions)
+
 	// Protected route
 	protected := r.Group("/api")
 	protected.Use(middleware.AuthRequired(), middleware.RateLimiter())
@@ -58,11 +100,59 @@ func main() {
 		})
 		protected.POST("/upload", middleware.EnforceQuota(), handlers.UploadFile)
 		protected.GET("/files", handlers.ListFiles)
+		protected.GET("/files/archive", handlers.DownloadArchive)
+		protected.PATCH("/files/:id", handlers.UpdateFile)
 		protected.DELETE("/files/:id", handlers.DeleteFile)
+		protected.GET("/files/:id/download", handlers.DownloadFile)
+		protected.HEAD("/files/:id/download", handlers.DownloadFile)
+		protected.GET("/files/:id/view", handlers.ViewFile)
+		protected.HEAD("/files/:id/view", handlers.ViewFile)
+		protected.PUT("/files/:id/tags", handlers.SetTags)
+		protected.POST("/files/:id/tags", handlers.AddTags)
+		protected.DELETE("/files/:id/tags/:tag", handlers.RemoveTag)
+		protected.GET("/files/:id/versions", handlers.ListVersions)
+		protected.PUT("/files/:id/versions/retention", handlers.SetVersionRetention)
+		protected.GET("/files/:id/versions/:version", handlers.DownloadVersion)
+		protected.HEAD("/files/:id/versions/:version", handlers.DownloadVersion)
+		protected.POST("/files/:id/versions/:version/restore", handlers.RestoreVersion)
+		protected.POST("/files/:id/links", handlers.CreateShareLink)
+		protected.GET("/files/:id/links", handlers.ListShareLinks)
+		protected.DELETE("/links/:id", handlers.RevokeShareLink)
+		protected.GET("/files/:id/grants", handlers.ListGrants)
+		protected.PUT("/files/:id/grants", handlers.GrantAccess)
+		protected.DELETE("/files/:id/grants/:userId", handlers.RevokeAccess)
+		protected.DELETE("/files/:id/group-grants/:groupId", handlers.RevokeGroupAccess)
+		protected.GET("/shared", handlers.ListSharedWithMe)
+		protected.GET("/trash", handlers.ListTrash)
+		protected.DELETE("/trash", handlers.EmptyTrash)
+		protected.POST("/trash/:id/restore", handlers.RestoreFile)
+		protected.DELETE("/trash/:id", handlers.PurgeFile)
+
+		protected.POST("/groups", handlers.CreateGroup)
+		protected.GET("/groups", handlers.ListGroups)
+		protected.GET("/groups/:id", handlers.GetGroup)
+		protected.DELETE("/groups/:id", handlers.DeleteGroup)
+		protected.PUT("/groups/:id/members", handlers.SetGroupMember)
+		protected.DELETE("/groups/:id/members/:userId", handlers.RemoveGroupMember)
+
+		protected.POST("/folders", handlers.CreateFolder)
+		protected.GET("/folders/:id", handlers.GetFolder)
+		protected.PATCH("/folders/:id", handlers.UpdateFolder)
+		protected.DELETE("/folders/:id", handlers.DeleteFolder)
+		protected.GET("/fs/*path", handlers.BrowsePath)
+		protected.HEAD("/fs/*path", handlers.BrowsePath)
+		protected.GET("/tags", handlers.ListTags)
+		protected.POST("/tags/rename", handlers.RenameTag)
 		protected.GET("/search", handlers.SearchFiles)
 		protected.GET("/profile", handlers.GetUserProfile)
 		protected.PUT("/files/:id/visibility", handlers.UpdateVisibility)
 
+		// Resumable uploads (tus 1.0)
+		protected.POST("/uploads", handlers.CreateUpload)
+		protected.HEAD("/uploads/:id", handlers.UploadOffset)
+		protected.PATCH("/uploads/:id", handlers.AppendUpload)
+		protected.DELETE("/uploads/:id", handlers.TerminateUpload)
+
 	}
 
 	// Admin routes
@@ -71,6 +161,11 @@ func main() {
 	{
 		admin.GET("/files", handlers.AdminListAllFiles)
 		admin.GET("/stats", handlers.AdminStats)
+		admin.GET("/gc", handlers.AdminGCReport)
+		admin.POST("/gc", handlers.AdminRunGC)
+		admin.GET("/integrity", handlers.AdminIntegrity)
+		admin.POST("/integrity/scrub", handlers.AdminStartScrub)
+		admin.PUT("/groups/:id/quota", handlers.AdminSetGroupQuota)
 	}
 
 	log.Println("Server running on :8080")
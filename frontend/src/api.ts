@@ -1,4 +1,4 @@
-import axios from "axios";
+import axios, { type AxiosInstance } from "axios";
 
 const API_BASE_URL = import.meta.env.VITE_API_URL || "http://localhost:8080";
 
@@ -23,3 +23,22 @@ adminApi.interceptors.request.use((config) => {
   return config;
 });
 
+
+// getAllPages follows next_cursor until a paginated list is exhausted and
+// returns every item.
+export async function getAllPages<T>(
+  api: AxiosInstance,
+  url: string,
+  params: Record<string, string> = {}
+): Promise<T[]> {
+  const items: T[] = [];
+  let cursor = "";
+  do {
+    const res = await api.get<{ items: T[] | null; next_cursor?: string }>(url, {
+      params: cursor ? { ...params, cursor } : params,
+    });
+    items.push(...(res.data.items ?? []));
+    cursor = res.data.next_cursor ?? "";
+  } while (cursor);
+  return items;
+}
@@ -1,5 +1,5 @@
 import { useEffect, useState } from "react";
-import { privateApi } from "../api";
+import { getAllPages, privateApi } from "../api";
 import {
   TrashIcon,
   EyeIcon,
@@ -32,9 +32,9 @@ export default function FileList({ refresh }: Props) {
     let ignore = false;
     const fetchFiles = async () => {
       try {
-        const res = await privateApi.get("/files");
+        const items = await getAllPages<FileItem>(privateApi, "/files");
         if (!ignore) {
-          setFiles(res.data.files || []);
+          setFiles(items);
           setError(null);
         }
       } catch (err) {
@@ -1,5 +1,5 @@
 import { useState } from "react";
-import { privateApi } from "../api";
+import { getAllPages, privateApi } from "../api";
 import {
   FunnelIcon,
   MagnifyingGlassIcon,
@@ -21,21 +21,19 @@ export default function SearchBar({ setResults }: Props) {
   const [dateTo, setDateTo] = useState("");
 
   const handleSimpleSearch = async () => {
-    const res = await privateApi.get(`/search?filename=${query}`);
-    setResults(res.data.results || []);
+    setResults(await getAllPages(privateApi, "/search", { filename: query }));
   };
 
   const handleAdvancedSearch = async () => {
-    const params = new URLSearchParams();
-    if (filename) params.append("filename", filename);
-    if (mimeType) params.append("mime", mimeType);
-    if (sizeMin) params.append("minSize", sizeMin);
-    if (sizeMax) params.append("maxSize", sizeMax);
-    if (dateFrom) params.append("startDate", dateFrom);
-    if (dateTo) params.append("endDate", dateTo);
+    const params: Record<string, string> = {};
+    if (filename) params.filename = filename;
+    if (mimeType) params.mime = mimeType;
+    if (sizeMin) params.minSize = sizeMin;
+    if (sizeMax) params.maxSize = sizeMax;
+    if (dateFrom) params.startDate = dateFrom;
+    if (dateTo) params.endDate = dateTo;
 
-    const res = await privateApi.get(`/search?${params.toString()}`);
-    setResults(res.data.results || []);
+    setResults(await getAllPages(privateApi, "/search", params));
   };
 
   return (
@@ -1,5 +1,5 @@
 import React, { useEffect, useState } from "react";
-import { adminApi } from "../api";
+import { adminApi, getAllPages } from "../api";
 import { useAuth } from "../content/AuthContext";
 
 import {
@@ -18,9 +18,7 @@ export default function Admin(): React.ReactElement {
   useEffect(() => {
     if (!role) return;
     // Fetch all files
-    adminApi.get("/admin/files").then((res) => {
-      setFiles(res.data.files || []);
-    });
+    getAllPages(adminApi, "/admin/files").then(setFiles);
 
     // Fetch system stats
     adminApi.get("/admin/stats").then((res) => {
@@ -1,5 +1,5 @@
 import React, { useState, useEffect, useMemo } from 'react';
-import { publicApi } from '../api';
+import { getAllPages, publicApi } from '../api';
 import type { PublicFileInfo } from '../types';
 import PublicFilesGrid from '../components/PublicFiles';
 import { MagnifyingGlassIcon, ExclamationCircleIcon } from '@heroicons/react/24/solid';
@@ -41,8 +41,7 @@ const LandingPage: React.FC = () => {
       setLoading(true);
       setError(null);
       try {
-        const response = await publicApi.get<PublicFileInfo[]>('/files/public');
-        setAllFiles(response.data ?? []);
+        setAllFiles(await getAllPages<PublicFileInfo>(publicApi, '/files/public'));
       } catch (err) {
         console.error("Failed to fetch public files:", err);
         setError('Could not load files. Please check your connection and try again later.');